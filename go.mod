@@ -1,3 +1,8 @@
 module github.com/exlee/ssort
 
 go 1.24.11
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/text v0.34.0
+)
@@ -4,49 +4,331 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
 )
 
 const VERSION = "v0.0.2"
 
+// commit is set at build time with -ldflags "-X main.commit=..."; otherwise
+// the VCS revision from the build info is used
+var commit string
+
+var ansiRegex = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+const (
+	highlightOn  = "\x1b[1;31m"
+	highlightOff = "\x1b[0m"
+	clearScreen  = "\x1b[H\x1b[2J"
+)
+
+// fingerprintPlaceholder replaces the --fingerprint matches in a template
+const fingerprintPlaceholder = "<*>"
+
+// unmatchedPriority sorts unmatched lines after every filter band
+const unmatchedPriority = 999999
+
+// Compiled --trim-prefix and --trim-suffix, nil when unset
+var trimPrefix, trimSuffix *regexp.Regexp
+
+// Compiled --format template, nil when unset
+var outputFormat *template.Template
+
+// alwaysExitZero turns every exit status into 0 (--always-exit-zero)
+var alwaysExitZero bool
+
+// binarySafe keeps input bytes as read: carriage returns stay and -i leaves
+// invalid UTF-8 alone (--binary-safe)
+var binarySafe bool
+
+// quietErrors silences non-fatal diagnostics (--quiet-errors)
+var quietErrors bool
+
+// pidFile is the --pid-file path, removed again on exit
+var pidFile string
+
+// defaultTimeout is the --timeout default, taken from SSORT_TIMEOUT if set
+var defaultTimeout = 500 * time.Millisecond
+
 // Config holds all application configuration
 type Config struct {
-	Filters      string
-	OnlyMatching bool
-	IgnoreCase   bool
-	Keep         bool
-	Limit        int
-	Timeout      time.Duration
-	Color        bool
-	WordBoundary bool
-	Exec         string
-	VersionFlag  bool
+	Filters              string
+	OnlyMatching         bool
+	IgnoreCase           bool
+	Keep                 bool
+	Limit                int
+	Timeout              time.Duration
+	Color                bool
+	WordBoundary         bool
+	Exec                 string
+	TailLines            int
+	URLDecode            bool
+	Head                 int
+	UnmatchedOut         string
+	AdaptiveFlush        bool
+	DropEmpty            bool
+	TieBreak             string
+	FlushCap             int
+	FlushCapCarry        bool
+	Exclude              listFlag
+	MatchReversed        bool
+	ExecStderr           string
+	Deterministic        bool
+	Stats                bool
+	QuietErrors          bool
+	FlushMarker          string
+	IgnoreFilterErrors   bool
+	Score                bool
+	Weights              string
+	InputBuffer          int
+	Delimiter            string
+	NoSort               bool
+	Highlight            bool
+	Repeat               time.Duration
+	CompareCmd           string
+	RateWindow           time.Duration
+	RateThreshold        int
+	StdinSplit           string
+	CountLines           bool
+	Hyperlinks           bool
+	StickyPriority       bool
+	Align                bool
+	DropUnmatched        bool
+	MinFields            int
+	ShowKey              bool
+	MaxFlushes           int
+	Runes                bool
+	Syslog               bool
+	SyslogTag            string
+	EchoComments         bool
+	DedupWindow          time.Duration
+	DedupKey             string
+	UnmatchedSort        string
+	WordBoundaryMode     string
+	AlwaysExitZero       bool
+	Transitions          bool
+	FilterDir            string
+	TrimPrefix           string
+	TrimSuffix           string
+	KeepLabel            string
+	MinLineLength        int
+	MaxLineLength        int
+	OnlyCapture          int
+	CaptureFallback      string
+	UnmatchedRatioLimit  float64
+	UnmatchedRatioWindow int
+	SplitDir             string
+	SplitTee             bool
+	NoFinalNewline       bool
+	Fingerprint          string
+	FinalTie             string
+	MinFreq              int
+	ExecEnv              listFlag
+	ExecDir              string
+	PriorityZeroWins     bool
+	FlushEvents          bool
+	IdleFlush            bool
+	PinTTL               time.Duration
+	Rate                 int
+	RateOverflow         string
+	TransformCmd         string
+	MaxBands             int
+	Prefix               string
+	PrefixColor          string
+	Squeeze              bool
+	Heartbeat            time.Duration
+	HeartbeatText        string
+	PriorityWins         bool
+	OutputRing           string
+	RingSize             int
+	StrictFileArgs       bool
+	ByMatchCount         bool
+	BinarySafe           bool
+	InitialDelay         time.Duration
+	JSONSortField        string
+	MatchCase            string
+	SortCase             string
+	FlushSeparator       string
+	Brief                bool
+	Interleave           bool
+	Prior                string
+	PriorWeight          float64
+	WarnUnused           bool
+	Stdin                bool
+	StreamMatches        bool
+	LimitBytes           byteSize
+	ByteCut              string
+	WordUnicode          bool
+	StateFile            string
+	GroupBy              string
+	GroupOrder           string
+	CollapseUnmatched    bool
+	CollapseText         string
+	WaitFor              string
+	WaitBacklog          bool
+	ContextChars         int
+	SortNumericField     string
+	Recolor              string
+	Join                 int
+	JoinDelimiter        string
+	TeeStderr            bool
+	Format               string
+	Trip                 string
+	TripCode             int
+	DedupeByFingerprint  bool
+	FingerprintSample    string
+	MaxMemory            byteSize
+	MemoryPolicy         string
+	Passthrough          bool
+	ReverseInput         bool
+	ByteOffsets          bool
+	FilterTimeout        time.Duration
+	HeaderFields         bool
+	MatchReport          bool
+	FlushReverse         bool
+	BufferSource         string
+	DryMatch             bool
+	Demote               listFlag
+	Promote              listFlag
+	InputEncoding        string
+	OutputEncoding       string
+	BandOrder            string
+	ControlFd            int
+	Canonical            bool
+	FlushOnPriority      int
+	PidFile              string
+	SourceOrder          string
+	HighlightAll         bool
+	Truncate             int
+	Watch                string
+	WatchInterval        time.Duration
+	Sample               int
+	SampleRandom         bool
+	SampleKeepMatches    bool
+	Flatten              bool
+	VersionFlag          bool
+	VersionJSON          bool
+	ColorTest            bool
+}
+
+// filter is a compiled priority filter
+type filter struct {
+	spec  string         // Filter as written, including any mode prefix
+	mode  string         // literal, re, glob, fields, near or expr
+	text  string         // Pattern without the mode prefix
+	re    *regexp.Regexp // nil for plain substring literals
+	size  int            // Match length used for the longest tie-break (literal and glob)
+	runes bool           // Measure regexp matches in runes (--runes)
+
+	weight int    // Contribution to the line score with --score
+	label  string // Comments above the filter, printed before its group (--echo-comments)
+	pinned bool   // pin: prefix, matches are repeated at the top of each flush
+	source string // file:line the filter was read from, empty if not from a file
+
+	fixedBand bool // priority= in a key=value filter line
+	band      int  // Band for fixedBand filters instead of the list position
+
+	unicodeWords bool // -w with --word-boundary-mode unicode or segment
+	segmentWords bool // -w with --word-boundary-mode segment
+
+	// Compound field filters ("1:ERROR && 3:db") and near(A,B,N), whose
+	// subs are A and B
+	delim    string
+	fields   []int
+	names    []string // --header-fields names of fields, "" for numbered ones
+	subs     []filter
+	distance int
+
+	expr  *exprNode // expr: filters
+	guard *exprNode // [when ...] block of the filter file, nil outside one
 }
 
 // item represents a buffered line
 type item struct {
-	raw      string // Original line with colors
-	clean    string // Line without colors for sorting/matching
-	priority int    // 0 is highest, MaxInt is unmatched
+	raw      string   // Original line with colors
+	clean    string   // Line without colors for sorting/matching
+	priority int      // 0 is highest, MaxInt is unmatched
+	marker   bool     // Decorative output line, not counted by --limit
+	match    *filter  // Winning filter, nil when unmatched
+	control  bool     // Terminal control sequence, written as-is without newline
+	kept     bool     // Unmatched line passed straight through by -k, gets --keep-label
+	lineNo   int      // Input line number, for --interleave and --format
+	offset   int64    // Byte offset in the input, for --byte-offsets
+	report   string   // --match-report list of every matching filter
+	all      []filter // --highlight-all, the filters the line was matched against
+	boost    float64  // --prior bands to move up by, at most --prior-weight
+	group    string   // --group-by key, valid if grouped
+	grouped  bool
+	num      float64 // --json-sort-field value, valid if hasNum
+	hasNum   bool
+}
+
+// inputLine is a line read from the input source, or a control event
+type inputLine struct {
+	text   string
+	event  int   // cycleStart/cycleEnd around each --repeat run, otherwise 0
+	offset int64 // Byte offset of the line in the input, for --byte-offsets
+	exec   bool  // Read from the -e command rather than stdin (--buffer-source)
 }
 
+const (
+	cycleStart = iota + 1
+	cycleEnd
+)
+
 func main() {
 	// 1. CLI Parsing
 	var cliCfg Config
+	if env := os.Getenv("SSORT_TIMEOUT"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err == nil && d < 0 {
+			err = errors.New("negative duration")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring SSORT_TIMEOUT '%s': %v\n", env, err)
+		} else {
+			defaultTimeout = d
+		}
+	}
 	cliFs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	defineFlags(cliFs, &cliCfg)
 
 	cliFs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] [filter_file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [filter_file] [-- pattern@priority ...]\n", os.Args[0])
 		cliFs.PrintDefaults()
 	}
 	cliFs.Parse(os.Args[1:])
@@ -56,21 +338,42 @@ func main() {
 	cliFs.Visit(func(f *flag.Flag) {
 		cliSet[f.Name] = true
 	})
+	fileSet := make(map[string]bool) // Flags set in the filter file
+
+	alwaysExitZero = cliCfg.AlwaysExitZero
 
 	if cliCfg.VersionFlag {
 		fmt.Printf("ssort, version: %s\n", VERSION)
 		os.Exit(0)
 	}
+	if cliCfg.VersionJSON {
+		printVersionJSON()
+		os.Exit(0)
+	}
+	if cliCfg.ColorTest {
+		printColorTest(os.Stdout)
+		os.Exit(0)
+	}
 
 	// 2. Identify and Read Filter File
 	var filterFileLines []string
 	args := cliFs.Args()
+
+	// Arguments after "--" are pattern@priority filters
+	var bandArgs []string
+	if flagTerminated(cliFs, os.Args[1:]) {
+		bandArgs, args = args, nil
+	} else if i := slices.Index(args, "--"); i >= 0 {
+		bandArgs, args = args[i+1:], args[:i]
+	}
+
+	filterPath := "" // Re-read on SIGHUP
 	if len(args) > 0 {
-		filename := args[0]
-		content, err := os.ReadFile(filename)
+		filterPath = args[0]
+		content, err := os.ReadFile(filterPath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error reading filter file: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		// Split lines manually to handle backslashes and comments
 		filterFileLines = strings.Split(string(content), "\n")
@@ -78,134 +381,501 @@ func main() {
 
 	// 3. Parse File Args and Filters
 	finalCfg := cliCfg // Start with CLI config
-	var filters []string
+	var filterSpecs []string
+	labels := map[int]string{}  // --echo-comments, by filterSpecs index
+	bands := map[int]int{}      // Explicit pattern@priority bands, by filterSpecs index
+	guards := map[int]string{}  // [when ...] guards, by filterSpecs index
+	sources := map[int]string{} // file:line of filters read from files, by filterSpecs index
 
 	if len(filterFileLines) > 0 {
-		// Filter out comments and extract args/filters
-		var processedLines []string
+		ff, err := parseFilterFile(filterFileLines, cliCfg.StrictFileArgs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing filter file: %v\n", err)
+			exit(1)
+		}
 
-		// Remove comments first
-		for _, line := range filterFileLines {
-			trim := strings.TrimSpace(line)
-			if strings.HasPrefix(trim, "#") {
+		// Parse the args found in file
+		if ff.args != "" {
+			var fileCfg Config
+			fileFs := flag.NewFlagSet("file", flag.ContinueOnError)
+			fileFs.SetOutput(io.Discard) // Silence errors or usage from file parsing
+			defineFlags(fileFs, &fileCfg)
+
+			// Tokenize respecting quotes
+			fileArgs := tokenize(ff.args)
+			if err := fileFs.Parse(fileArgs); err != nil {
+				fmt.Fprintf(os.Stderr, "Error parsing args in file: %v\n", err)
+				exit(1)
+			}
+
+			// Merge: Apply file config if NOT set in CLI
+			applyFileConfig(&finalCfg, fileFs, cliSet)
+			fileFs.Visit(func(f *flag.Flag) {
+				fileSet[f.Name] = true
+			})
+		}
+
+		for i, spec := range ff.specs {
+			if finalCfg.EchoComments && ff.labels[i] != "" {
+				labels[len(filterSpecs)] = ff.labels[i]
+			}
+			if g, ok := ff.guards[i]; ok {
+				guards[len(filterSpecs)] = g
+			}
+			sources[len(filterSpecs)] = fmt.Sprintf("%s:%d", filterPath, ff.lines[i])
+			filterSpecs = append(filterSpecs, spec)
+		}
+	}
+	fileSpecs := len(filterSpecs) // Filters from the filter file, replaced on SIGHUP
+
+	// Add filters from --filter-dir, one file after another in name order
+	if finalCfg.FilterDir != "" {
+		dir := expand(finalCfg.FilterDir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading filter directory: %v\n", err)
+			exit(1)
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
 				continue
 			}
-			processedLines = append(processedLines, line)
+			path := filepath.Join(dir, e.Name())
+			content, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading filter file: %v\n", err)
+				exit(1)
+			}
+			var pending []string
+			for n, line := range strings.Split(string(content), "\n") {
+				t := strings.TrimSpace(line)
+				switch {
+				case strings.HasPrefix(t, "#"):
+					pending = append(pending, t)
+				case t != "":
+					if finalCfg.EchoComments && len(pending) > 0 {
+						labels[len(filterSpecs)] = strings.Join(pending, "\n")
+					}
+					sources[len(filterSpecs)] = fmt.Sprintf("%s:%d", path, n+1)
+					pending = nil
+					filterSpecs = append(filterSpecs, t)
+				}
+			}
+		}
+	}
+
+	// Add CLI filters (from -f flag)
+	if finalCfg.Filters != "" {
+		parts := splitFilterList(finalCfg.Filters)
+		for _, p := range parts {
+			if trimmed := strings.TrimSpace(p); trimmed != "" {
+				filterSpecs = append(filterSpecs, trimmed)
+			}
+		}
+	}
+
+	// Add filters from after "--"; a numeric suffix after the last @ is the
+	// band, anything else is a plain filter at its list position
+	for _, arg := range bandArgs {
+		spec := arg
+		if at := strings.LastIndex(arg, "@"); at > 0 {
+			if n, err := strconv.Atoi(arg[at+1:]); err == nil {
+				if n < 0 || n >= unmatchedPriority {
+					fmt.Fprintf(os.Stderr, "Invalid priority in '%s'\n", arg)
+					exit(1)
+				}
+				spec = arg[:at]
+				bands[len(filterSpecs)] = n
+			}
+		}
+		if spec != "" {
+			filterSpecs = append(filterSpecs, spec)
 		}
+	}
 
-		if len(processedLines) > 0 {
-			first := processedLines[0]
-			trimFirst := strings.TrimSpace(first)
+	quietErrors = finalCfg.QuietErrors
+	alwaysExitZero = finalCfg.AlwaysExitZero
+	binarySafe = finalCfg.BinarySafe
 
-			// Check if first line is an argument line
-			// Condition: Starts with "-" OR starts with whitespace (blanks)
-			isArgLine := strings.HasPrefix(trimFirst, "-") || (len(first) > 0 && (first[0] == ' ' || first[0] == '\t'))
+	// With --stdin-split, stdin starts with filters up to the sentinel line
+	var stdin io.Reader = os.Stdin
+	if finalCfg.StdinSplit != "" {
+		br := bufio.NewReader(os.Stdin)
+		for {
+			line, err := br.ReadString('\n')
+			line = strings.TrimRight(line, "\r\n")
+			if line == finalCfg.StdinSplit {
+				break
+			}
+			if t := strings.TrimSpace(line); t != "" && !strings.HasPrefix(t, "#") {
+				filterSpecs = append(filterSpecs, t)
+			}
+			if err != nil {
+				break // No sentinel: everything was filters
+			}
+		}
+		stdin = br
+	}
 
-			argLineEndIndex := -1
+	// -i is shorthand for --match-case fold --sort-case fold; either can be
+	// overridden on its own
+	defaultCase := "preserve"
+	if finalCfg.IgnoreCase {
+		defaultCase = "fold"
+	}
+	for _, v := range []*string{&finalCfg.MatchCase, &finalCfg.SortCase} {
+		if *v == "" {
+			*v = defaultCase
+		}
+	}
+	// From here on IgnoreCase only means folding for matching
+	finalCfg.IgnoreCase = finalCfg.MatchCase == "fold"
 
-			if isArgLine {
-				// Parse argument block (handle backslash extension)
-				var argBuilder strings.Builder
+	// --stream-matches is shorthand for -o --no-sort
+	if finalCfg.StreamMatches {
+		finalCfg.OnlyMatching, finalCfg.NoSort = true, true
+	}
 
-				for i, line := range processedLines {
-					trim := strings.TrimSpace(line)
-					hasBackslash := strings.HasSuffix(trim, "\\")
+	// --priority-wins is shorthand for --tie-break firstlisted
+	if finalCfg.PriorityWins {
+		// Only a --tie-break given, even the default longest, conflicts
+		if (cliSet["tie-break"] || fileSet["tie-break"]) && finalCfg.TieBreak != "firstlisted" {
+			fmt.Fprintf(os.Stderr, "--priority-wins conflicts with --tie-break %s\n", finalCfg.TieBreak)
+			exit(1)
+		}
+		finalCfg.TieBreak = "firstlisted"
+	}
 
-					content := trim
-					if hasBackslash {
-						content = strings.TrimSuffix(content, "\\")
-					}
+	// --word-unicode is shorthand for -w --word-boundary-mode segment
+	if finalCfg.WordUnicode {
+		finalCfg.WordBoundary, finalCfg.WordBoundaryMode = true, "segment"
+	}
 
-					if argBuilder.Len() > 0 {
-						argBuilder.WriteString(" ")
-					}
-					argBuilder.WriteString(content)
+	if err := validateConfig(&finalCfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
 
-					if !hasBackslash {
-						argLineEndIndex = i
-						break
-					}
-				}
+	// Hyperlinks are escape codes only a terminal understands
+	if finalCfg.Hyperlinks && !isTerminal(os.Stdout) {
+		finalCfg.Hyperlinks = false
+	}
 
-				// Parse the args found in file
-				if argBuilder.Len() > 0 {
-					var fileCfg Config
-					fileFs := flag.NewFlagSet("file", flag.ContinueOnError)
-					fileFs.SetOutput(io.Discard) // Silence errors or usage from file parsing
-					defineFlags(fileFs, &fileCfg)
+	// 4. Pre-compile Regex
+	filters, err := compileFilters(filterSpecs, labels, bands, guards, sources, &finalCfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
 
-					// Tokenize respecting quotes
-					fileArgs := tokenize(argBuilder.String())
-					if err := fileFs.Parse(fileArgs); err != nil {
-						fmt.Fprintf(os.Stderr, "Error parsing args in file: %v\n", err)
-						os.Exit(1)
-					}
+	// --canonical: no timer flushes and no fast path, so only the input
+	// decides the output; ties go to the raw line, then input order
+	if finalCfg.Canonical {
+		finalCfg.Deterministic = true
+		finalCfg.FinalTie = "raw"
+	}
 
-					// Merge: Apply file config if NOT set in CLI
-					applyFileConfig(&finalCfg, &fileCfg, cliSet)
+	// --dry-match shows how each line is classified, in input order
+	if finalCfg.DryMatch {
+		finalCfg.NoSort = true
+	}
+
+	// --passthrough without filters: nothing to prioritize, so nothing is
+	// held back. Unless other flags change lines, input is copied as is.
+	rawCopy := false
+	if finalCfg.Passthrough && len(filters) == 0 {
+		rawCopy = onlyInputFlags(cliSet) && onlyInputFlags(fileSet)
+		finalCfg.NoSort = true
+	}
+
+	// --by-match-count is --score with every filter weighing 1
+	if finalCfg.ByMatchCount {
+		finalCfg.Score = true
+	}
+
+	// Weights for --score: explicit --weights in filter order, otherwise the
+	// first filter weighs the most
+	maxScore, err := weighFilters(filters, &finalCfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	// Exclusions share modes and -i/-w handling with the filters
+	var excludes []filter
+	for _, csv := range finalCfg.Exclude {
+		for _, p := range splitFilterList(csv) {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			f, err := compileFilter(p, &finalCfg)
+			if err != nil {
+				if finalCfg.IgnoreFilterErrors {
+					warnf("Skipping invalid exclude pattern '%s': %v\n", p, err)
+					continue
 				}
+				fmt.Fprintf(os.Stderr, "Invalid exclude pattern '%s': %v\n", p, err)
+				exit(1)
 			}
+			excludes = append(excludes, f)
+		}
+	}
+
+	// --input-encoding and --output-encoding: ssort works in UTF-8 and
+	// transcodes at the edges
+	var inputEnc, outputEnc encoding.Encoding
+	for _, e := range []struct {
+		flag, name string
+		enc        *encoding.Encoding
+	}{
+		{"--input-encoding", finalCfg.InputEncoding, &inputEnc},
+		{"--output-encoding", finalCfg.OutputEncoding, &outputEnc},
+	} {
+		if e.name == "" {
+			continue
+		}
+		enc, err := lookupEncoding(e.name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid %s '%s': %v\n", e.flag, e.name, err)
+			exit(1)
+		}
+		*e.enc = enc
+	}
 
-			// The rest are filters
-			startFilterIdx := argLineEndIndex + 1
-			for i := startFilterIdx; i < len(processedLines); i++ {
-				l := processedLines[i]
-				if t := strings.TrimSpace(l); t != "" {
-					filters = append(filters, t)
+	// --demote and --promote shift the band of matched lines after the
+	// filter scan; they compile like exclusions
+	var shifts []bandShift
+	for _, opt := range []struct {
+		flag string
+		list listFlag
+		sign int
+	}{{"--demote", finalCfg.Demote, 1}, {"--promote", finalCfg.Promote, -1}} {
+		for _, csv := range opt.list {
+			for _, p := range splitFilterList(csv) {
+				p = strings.TrimSpace(p)
+				if p == "" {
+					continue
+				}
+				delta := 1
+				if at := strings.LastIndex(p, "@"); at > 0 {
+					if n, err := strconv.Atoi(p[at+1:]); err == nil {
+						if n < 1 {
+							fmt.Fprintf(os.Stderr, "Invalid %s shift in '%s': must be at least 1\n", opt.flag, p)
+							exit(1)
+						}
+						p, delta = p[:at], n
+					}
+				}
+				f, err := compileFilter(p, &finalCfg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Invalid %s pattern '%s': %v\n", opt.flag, p, err)
+					exit(1)
 				}
+				shifts = append(shifts, bandShift{f: f, delta: opt.sign * delta})
 			}
 		}
 	}
 
-	// Add CLI filters (from -f flag)
-	if finalCfg.Filters != "" {
-		parts := strings.Split(finalCfg.Filters, ",")
-		for _, p := range parts {
-			if trimmed := strings.TrimSpace(p); trimmed != "" {
-				filters = append(filters, trimmed)
-			}
+	// --dedup-key picks the part of a line --dedup-window compares
+	var dedupKey *regexp.Regexp
+	if finalCfg.DedupKey != "" {
+		re, err := regexp.Compile(finalCfg.DedupKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --dedup-key '%s': %v\n", finalCfg.DedupKey, err)
+			exit(1)
 		}
+		dedupKey = re
 	}
 
-	// 4. Pre-compile Regex
-	ansiRegex := regexp.MustCompile(`\x1b\[[0-9;]*m`)
-	var filterRegexps []*regexp.Regexp
-	if finalCfg.WordBoundary {
-		for _, f := range filters {
-			if finalCfg.IgnoreCase {
-				f = strings.ToLower(f)
-			}
+	// --group-by forms bands from a value in the line instead of the filters
+	var groupBy *regexp.Regexp
+	if finalCfg.GroupBy != "" {
+		re, err := regexp.Compile(finalCfg.GroupBy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --group-by '%s': %v\n", finalCfg.GroupBy, err)
+			exit(1)
+		}
+		groupBy = re
+	}
 
-			pattern := `\b` + regexp.QuoteMeta(f) + `\b`
-			re, err := regexp.Compile(pattern)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Invalid filter pattern '%s': %v\n", f, err)
-				os.Exit(1)
+	// --wait-for holds all output back until a line matches it
+	var waitFor *regexp.Regexp
+	if finalCfg.WaitFor != "" {
+		re, err := regexp.Compile(finalCfg.WaitFor)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --wait-for '%s': %v\n", finalCfg.WaitFor, err)
+			exit(1)
+		}
+		waitFor = re
+	}
+
+	// --join-delimiter starts a new record at each line it matches
+	var joinDelim *regexp.Regexp
+	if finalCfg.JoinDelimiter != "" {
+		re, err := regexp.Compile(finalCfg.JoinDelimiter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --join-delimiter '%s': %v\n", finalCfg.JoinDelimiter, err)
+			exit(1)
+		}
+		joinDelim = re
+	}
+
+	// --trip ends the run at the first line it matches
+	var trip *regexp.Regexp
+	if finalCfg.Trip != "" {
+		re, err := regexp.Compile(finalCfg.Trip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --trip '%s': %v\n", finalCfg.Trip, err)
+			exit(1)
+		}
+		trip = re
+	}
+
+	// --sort-numeric-field takes a number, or a name resolved from the
+	// --header-fields header
+	sortField, sortFieldName := 0, ""
+	if v := finalCfg.SortNumericField; v != "" {
+		n, err := strconv.Atoi(v)
+		switch {
+		case err == nil && n < 0:
+			fmt.Fprintf(os.Stderr, "Invalid --sort-numeric-field %d: fields count from 1\n", n)
+			exit(1)
+		case err == nil:
+			sortField = n
+		case !finalCfg.HeaderFields:
+			fmt.Fprintf(os.Stderr, "Invalid --sort-numeric-field '%s': field names need --header-fields\n", v)
+			exit(1)
+		default:
+			sortFieldName = v
+		}
+	}
+	if (sortField > 0 || sortFieldName != "") && finalCfg.JSONSortField != "" {
+		fmt.Fprintln(os.Stderr, "--sort-numeric-field conflicts with --json-sort-field")
+		exit(1)
+	}
+	if finalCfg.Sample == 0 && (finalCfg.SampleRandom || finalCfg.SampleKeepMatches) {
+		warnf("Ignoring --sample-random and --sample-keep-matches without --sample\n")
+	}
+	if finalCfg.BandOrder == "input" && (sortField > 0 || sortFieldName != "") {
+		fmt.Fprintln(os.Stderr, "--band-order input conflicts with --sort-numeric-field")
+		exit(1)
+	}
+
+	// Offsets only mean something in a file an editor can seek in
+	if finalCfg.ByteOffsets && !seekableStdin(finalCfg) {
+		warnf("Ignoring --byte-offsets: it needs a file on stdin (ssort < file)\n")
+		finalCfg.ByteOffsets = false
+	}
+
+	// Trims are anchored to their end of the line
+	for _, t := range []struct {
+		flag, value, anchored string
+		re                    **regexp.Regexp
+	}{
+		{"--trim-prefix", finalCfg.TrimPrefix, `^(?:%s)`, &trimPrefix},
+		{"--trim-suffix", finalCfg.TrimSuffix, `(?:%s)$`, &trimSuffix},
+	} {
+		if t.value == "" {
+			continue
+		}
+		re, err := regexp.Compile(fmt.Sprintf(t.anchored, t.value))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", t.flag, err)
+			exit(1)
+		}
+		*t.re = re
+	}
+
+	if finalCfg.Format != "" {
+		tmpl, err := template.New("format").Parse(finalCfg.Format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --format: %v\n", err)
+			exit(1)
+		}
+		outputFormat = tmpl
+	}
+
+	var fingerprint *regexp.Regexp
+	if finalCfg.Fingerprint != "" {
+		re, err := regexp.Compile(finalCfg.Fingerprint)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --fingerprint '%s': %v\n", finalCfg.Fingerprint, err)
+			exit(1)
+		}
+		fingerprint = re
+	}
+
+	// --prior: lines of an earlier run's output, keyed like the sort key,
+	// with how often each appeared
+	var prior map[string]int
+	priorMax := 0
+	if finalCfg.Prior != "" {
+		content, err := os.ReadFile(expand(finalCfg.Prior))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading --prior file: %v\n", err)
+			exit(1)
+		}
+		prior = map[string]int{}
+		for _, l := range strings.Split(string(content), "\n") {
+			l = ansiRegex.ReplaceAllString(strings.TrimRight(l, "\r"), "")
+			if l == "" {
+				continue
+			}
+			if finalCfg.SortCase == "fold" {
+				l = lowerCase(l)
+			}
+			if fingerprint != nil {
+				l = fingerprint.ReplaceAllString(l, fingerprintPlaceholder)
 			}
-			filterRegexps = append(filterRegexps, re)
+			prior[l]++
+			priorMax = max(priorMax, prior[l])
 		}
 	}
 
-	// 5. Input Source Setup
-	linesCh := make(chan string, 100) // Small buffer to smooth input
+	// --transform-cmd runs for the whole session, one line in, one line out
+	var transform *coprocess
+	if finalCfg.TransformCmd != "" {
+		cp, err := startCoprocess(finalCfg.TransformCmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting transform command '%s': %v\n", finalCfg.TransformCmd, err)
+			exit(1)
+		}
+		transform = cp
+	}
 
-	go func() {
-		defer close(linesCh)
+	// 5. Input Source Setup
+	linesCh := make(chan inputLine, finalCfg.InputBuffer) // Small buffer to smooth input
 
-		var input io.Reader
+	// readInput feeds one full run of the input source into linesCh
+	readInput := func(ctx context.Context) {
+		var inputs []io.Reader
 		var cmd *exec.Cmd
 
 		if finalCfg.Exec != "" {
 			// Execute command
-			tokens := tokenize(finalCfg.Exec)
-			if len(tokens) > 0 {
-				// Expand paths/env in tokens
-				for i := range tokens {
-					tokens[i] = expand(tokens[i])
+			cmd = newCommand(ctx, finalCfg.Exec)
+			if cmd != nil {
+				if len(finalCfg.ExecEnv) > 0 {
+					cmd.Env = append(os.Environ(), finalCfg.ExecEnv...)
+				}
+				if finalCfg.ExecDir != "" {
+					cmd.Dir = expand(finalCfg.ExecDir)
+				}
+				switch finalCfg.ExecStderr {
+				case "separate":
+					if !quietErrors {
+						cmd.Stderr = os.Stderr
+					}
+				case "merge":
+					// Error lines get sorted along with regular output
+					stderr, err := cmd.StderrPipe()
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error creating stderr pipe: %v\n", err)
+						return
+					}
+					inputs = append(inputs, stderr)
 				}
-
-				cmd = exec.Command(tokens[0], tokens[1:]...)
-				cmd.Stderr = os.Stderr
 				stdout, err := cmd.StdoutPipe()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error creating stdout pipe: %v\n", err)
@@ -215,242 +885,4474 @@ func main() {
 					fmt.Fprintf(os.Stderr, "Error starting command '%s': %v\n", finalCfg.Exec, err)
 					return
 				}
-				input = stdout
+				inputs = append(inputs, stdout)
 			} else {
 				fmt.Fprintln(os.Stderr, "Empty executable command")
 				return
 			}
-		} else {
-			// Standard Input
-			input = os.Stdin
 		}
-
-		scanner := bufio.NewScanner(input)
-		// Increase buffer to 10MB to avoid "token too long" errors on minified files
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 10*1024*1024)
-
-		for scanner.Scan() {
-			linesCh <- scanner.Text()
+		// --watch reads its file instead of stdin. The file may be gone
+		// for a moment while it's rewritten; the next change brings it back.
+		if finalCfg.Watch != "" {
+			f, err := os.Open(expand(finalCfg.Watch))
+			if err != nil {
+				warnf("Error reading --watch file: %v\n", err)
+				return
+			}
+			defer f.Close()
+			inputs = append(inputs, f)
 		}
 
-		if err := scanner.Err(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		// Standard Input, unless a command replaces it; --stdin reads both
+		execInputs := len(inputs)
+		if (finalCfg.Exec == "" && finalCfg.Watch == "") || finalCfg.Stdin {
+			inputs = append(inputs, stdin)
 		}
 
-		if cmd != nil {
-			// Wait for command to finish (ignore exit code)
-			_ = cmd.Wait()
+		// With --tail-lines only the last N lines are kept (ring buffer) and
+		// released at EOF, so nothing is emitted until input ends.
+		var tail *ring
+		var tailMu sync.Mutex
+		if finalCfg.TailLines > 0 {
+			tail = newRing(finalCfg.TailLines)
 		}
-	}()
-
-	// 6. Processing Loop Setup
-	var resultsLimit (*int)
-	if finalCfg.Limit > 0 {
-		limit := finalCfg.Limit
-		resultsLimit = &limit
-	}
-
-	printCh := make(chan string, 100) // Buffer print channel slightly
-	printDone := make(chan struct{})
 
-	go func() {
-		defer close(printDone)
-		for line := range printCh {
-			fmt.Println(line)
-			if resultsLimit != nil {
-				*resultsLimit--
-				if *resultsLimit <= 0 {
-					break
-				}
+		// --passthrough copies a single input straight to stdout; several
+		// would interleave mid-line
+		if rawCopy && len(inputs) == 1 {
+			input, err := decompress(inputs[0])
+			if err == nil {
+				_, err = io.Copy(os.Stdout, input)
 			}
-		}
-		// Drain if limit reached but generator still going
-		for range printCh {
-		}
-	}()
-
-	var buffer []item
-	prioritizedCount := 0
-	const unmatchedPriority = 999999
-
-	ticker := time.NewTicker(finalCfg.Timeout)
-	defer ticker.Stop()
-
-	flush := func() {
-		if len(buffer) == 0 {
-			return
-		}
-		sort.SliceStable(buffer, func(i, j int) bool {
-			if buffer[i].priority != buffer[j].priority {
-				return buffer[i].priority < buffer[j].priority
+			if err != nil {
+				warnf("Error reading input: %v\n", err)
 			}
-			return buffer[i].clean < buffer[j].clean
-		})
-		for _, it := range buffer {
-			printCh <- it.raw
+			if cmd != nil {
+				_ = cmd.Wait()
+			}
+			return
 		}
-		buffer = buffer[:0]
-		prioritizedCount = 0
-		ticker.Reset(finalCfg.Timeout)
-	}
 
-	// 7. Main Event Loop
-	for {
-		select {
-		case line, ok := <-linesCh:
-			if !ok {
-				flush()
-				close(printCh) // Signal printer to finish
-				<-printDone    // Wait for printer to finish
+		readSource := func(input io.Reader, fromExec bool) {
+			input, err := decompress(input)
+			if err != nil {
+				warnf("Error opening compressed input: %v\n", err)
 				return
 			}
-
-			cleanLine := line
-			if finalCfg.Color {
-				cleanLine = ansiRegex.ReplaceAllString(line, "")
-			}
-			if finalCfg.IgnoreCase {
-				cleanLine = strings.ToLower(cleanLine)
+			if inputEnc != nil {
+				input = inputEnc.NewDecoder().Reader(input)
 			}
 
-			matchedIndex := -1
-			matchLen := 0
-
-			for i, f := range filters {
-				matched := false
-				if finalCfg.WordBoundary {
-					matched = filterRegexps[i].MatchString(cleanLine)
-				} else {
-					if finalCfg.IgnoreCase {
-						f = strings.ToLower(f)
-					}
-					matched = strings.Contains(cleanLine, f)
+			scanner := bufio.NewScanner(input)
+			// Increase buffer to 10MB to avoid "token too long" errors on minified files
+			buf := make([]byte, 0, 64*1024)
+			scanner.Buffer(buf, 10*1024*1024)
+			split := bufio.ScanLines
+			if binarySafe {
+				split = scanRawLines
+			}
+			// --byte-offsets: count what each line took, newline included
+			var start, next int64
+			scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+				advance, token, err := split(data, atEOF)
+				if token != nil {
+					start = next
 				}
+				next += int64(advance)
+				return advance, token, err
+			})
 
-				if matched {
-					if len(f) > matchLen {
-						matchedIndex = i
-						matchLen = len(f)
-					}
+			for scanner.Scan() {
+				l := inputLine{text: scanner.Text(), offset: start, exec: fromExec}
+				if tail != nil {
+					tailMu.Lock()
+					tail.push(l)
+					tailMu.Unlock()
+					continue
 				}
+				linesCh <- l
 			}
 
-			// Case A: Highest Priority
-			if matchedIndex == 0 {
-				printCh <- line
-				prioritizedCount++
-				continue
+			if err := scanner.Err(); err != nil {
+				warnf("Error reading input: %v\n", err)
 			}
+		}
 
-			// Case B: Unmatched
-			if matchedIndex == -1 {
-				if finalCfg.OnlyMatching {
-					continue
-				}
-				if finalCfg.Keep {
-					fmt.Println(line)
-				} else {
-					buffer = append(buffer, item{raw: line, clean: cleanLine, priority: unmatchedPriority})
-				}
-				continue
+		// --source-order: the -e command's output (stdout, merged stderr)
+		// and stdin at once, or one fully before the other
+		var wg sync.WaitGroup
+		readAll := func(inputs []io.Reader, fromExec bool) {
+			for _, input := range inputs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					readSource(input, fromExec)
+				}()
 			}
+		}
+		execIn, stdinIn := inputs[:execInputs], inputs[execInputs:]
+		switch finalCfg.SourceOrder {
+		case "stdin-first":
+			readAll(stdinIn, false)
+			wg.Wait()
+			readAll(execIn, true)
+		case "exec-first":
+			readAll(execIn, true)
+			wg.Wait()
+			readAll(stdinIn, false)
+		default:
+			readAll(execIn, true)
+			readAll(stdinIn, false)
+		}
+		wg.Wait()
 
-			// Case C: Buffered
-			buffer = append(buffer, item{raw: line, clean: cleanLine, priority: matchedIndex})
-			prioritizedCount++
-
-			if finalCfg.Limit > 0 && prioritizedCount >= finalCfg.Limit {
-				flush()
+		if tail != nil {
+			for _, l := range tail.lines() {
+				linesCh <- l
 			}
-
-		case <-ticker.C:
-			flush()
 		}
+
+		if cmd != nil {
+			// Wait for command to finish (ignore exit code)
+			_ = cmd.Wait()
+		}
+	}
+
+	go func() {
+		defer close(linesCh)
+
+		if finalCfg.Watch != "" {
+			// --watch: a run for the file as it is, then one for every
+			// change seen when polling; a missing file is waited out
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			path := expand(finalCfg.Watch)
+			var last os.FileInfo
+			for {
+				st, err := os.Stat(path)
+				if err == nil && (last == nil || !st.ModTime().Equal(last.ModTime()) || st.Size() != last.Size()) {
+					last = st
+					linesCh <- inputLine{event: cycleStart}
+					readInput(ctx)
+					linesCh <- inputLine{event: cycleEnd}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(finalCfg.WatchInterval):
+				}
+			}
+		}
+
+		if finalCfg.Repeat <= 0 {
+			readInput(context.Background())
+			return
+		}
+
+		// --repeat: re-run the command every interval until interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		for {
+			linesCh <- inputLine{event: cycleStart}
+			readInput(ctx)
+			linesCh <- inputLine{event: cycleEnd}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(finalCfg.Repeat):
+			}
+		}
+	}()
+
+	// 6. Processing Loop Setup
+	// --syslog sends output to the local syslog instead of stdout
+	var sysLog syslogWriter
+	if finalCfg.Syslog {
+		w, err := dialSyslog(finalCfg.SyslogTag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting to syslog: %v\n", err)
+			exit(1)
+		}
+		sysLog = w
+		defer sysLog.Close()
+	}
+
+	printCh := make(chan item, 100) // Buffer print channel slightly
+	printDone := make(chan struct{})
+
+	// --split-dir writes each band to its own file
+	var split *bandFiles
+	if finalCfg.SplitDir != "" {
+		dir := expand(finalCfg.SplitDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating split directory: %v\n", err)
+			exit(1)
+		}
+		split = &bandFiles{dir: dir, files: map[int]*bandFile{}}
+	}
+
+	var ring *ringFile
+	if finalCfg.OutputRing != "" {
+		ring = &ringFile{path: expand(finalCfg.OutputRing), lines: make([]string, finalCfg.RingSize)}
+	}
+
+	go func() {
+		defer close(printDone)
+		if split != nil {
+			defer split.close()
+		}
+		if ring != nil {
+			defer ring.close()
+		}
+		// --rate buffer: lines wait for a token here; the drop mode is
+		// part of the outputGate
+		var bucket *tokenBucket
+		if finalCfg.Rate > 0 && finalCfg.RateOverflow == "buffer" {
+			bucket = newTokenBucket(finalCfg.Rate, time.Now())
+		}
+
+		// --heartbeat: a quiet spell of the given length gets a line on
+		// stderr, the timer restarts with every line printed
+		var heartbeat *time.Timer
+		if finalCfg.Heartbeat > 0 {
+			heartbeat = time.AfterFunc(finalCfg.Heartbeat, func() {
+				fmt.Fprintln(os.Stderr, strings.ReplaceAll(finalCfg.HeartbeatText, "{time}", time.Now().Format(time.RFC3339)))
+				heartbeat.Reset(finalCfg.Heartbeat)
+			})
+			defer heartbeat.Stop()
+		}
+
+		out := newLineWriter(&finalCfg, outputEnc)
+		defer out.close()
+
+		for it := range printCh {
+			if it.control {
+				if sysLog == nil {
+					out.newCycle(it.raw)
+				}
+				continue
+			}
+			if bucket != nil && !it.marker {
+				time.Sleep(bucket.wait(time.Now()))
+			}
+			line := render(it, &finalCfg)
+			if split != nil && !it.marker {
+				split.write(it.priority, line)
+			}
+			if ring != nil && !it.marker {
+				ring.write(line)
+			}
+			switch {
+			case split != nil && !finalCfg.SplitTee:
+			case sysLog != nil:
+				if err := logItem(sysLog, it, line); err != nil {
+					warnf("Error writing to syslog: %v\n", err)
+				}
+			default:
+				out.write(line)
+			}
+			if heartbeat != nil {
+				heartbeat.Reset(finalCfg.Heartbeat)
+			}
+		}
+	}()
+
+	// Unmatched lines can be diverted to a file by their own writer
+	var unmatchedCh chan string
+	unmatchedDone := make(chan struct{})
+	if finalCfg.UnmatchedOut != "" {
+		f, err := os.Create(expand(finalCfg.UnmatchedOut))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating unmatched file: %v\n", err)
+			exit(1)
+		}
+		unmatchedCh = make(chan string, 100)
+		go func() {
+			defer close(unmatchedDone)
+			w := bufio.NewWriter(f)
+			for line := range unmatchedCh {
+				fmt.Fprintln(w, line)
+			}
+			if err := w.Flush(); err != nil {
+				warnf("Error writing unmatched file: %v\n", err)
+			}
+			f.Close()
+		}()
+	} else {
+		close(unmatchedDone)
+	}
+
+	var buffer []item
+	prioritizedCount := 0 // Matched lines in buffer, for --limit
+
+	// Without a clock (--deterministic or --timeout 0) flushes only happen on
+	// --limit and EOF, so output depends on input and config alone
+	var ticker *time.Ticker
+	var tickCh <-chan time.Time
+	if !finalCfg.Deterministic && finalCfg.Timeout > 0 {
+		period := finalCfg.Timeout
+		if finalCfg.InitialDelay > 0 {
+			period = finalCfg.InitialDelay
+		}
+		ticker = time.NewTicker(period)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
+	resetTicker := func(d time.Duration) {
+		if ticker != nil {
+			ticker.Reset(d)
+		}
+	}
+
+	lastFlush := time.Now()
+	var fastGroup *filter // Last group labeled on the fast path (--echo-comments)
+	flushes := 0          // non-empty flushes, for --max-flushes
+
+	// flushPeriod is --timeout, or --initial-delay until the first flush
+	flushPeriod := func() time.Duration {
+		if flushes == 0 && finalCfg.InitialDelay > 0 {
+			return finalCfg.InitialDelay
+		}
+		return finalCfg.Timeout
+	}
+
+	var pins *pinSet
+	for _, f := range filters {
+		if f.pinned {
+			pins = &pinSet{ttl: finalCfg.PinTTL, lines: map[string]pinnedLine{}}
+			break
+		}
+	}
+
+	// --limit: lines left to print in this run. Every line sent to the
+	// printer counts, whether straight away or by a flush, unless the gate
+	// drops it; once none are left, nothing but control codes goes out.
+	limitLeft := finalCfg.Limit
+	gate := newOutputGate(&finalCfg)
+	send := func(it item) {
+		// Unmatched lines passed straight through (-k) neither count nor stop
+		limited := finalCfg.Limit > 0 && !it.kept
+		if limited && limitLeft <= 0 {
+			return
+		}
+		if gate.drop(it) {
+			return
+		}
+		if limited && !it.marker {
+			limitLeft--
+		}
+		printCh <- it
+	}
+
+	bandsWarned := false    // --max-bands warns once
+	flushedOutput := false  // A flush printed something, --flush-separator goes before the next
+	bufferBytes := int64(0) // --max-memory, approximate size of buffer
+	evictWarned := false
+
+	flush := func(reason string) {
+		lastFlush = time.Now()
+		if len(buffer) == 0 {
+			if finalCfg.AdaptiveFlush {
+				resetTicker(finalCfg.Timeout)
+			}
+			return
+		}
+		var ranks map[string]int
+		if groupBy != nil {
+			ranks = groupRanks(buffer, finalCfg.GroupOrder)
+		}
+		less := func(i, j int) bool {
+			// --group-by: groups first, lines without a key last
+			if ranks != nil {
+				ri, rj := len(ranks), len(ranks)
+				if buffer[i].grouped {
+					ri = ranks[buffer[i].group]
+				}
+				if buffer[j].grouped {
+					rj = ranks[buffer[j].group]
+				}
+				if ri != rj {
+					return ri < rj
+				}
+			}
+			// --interleave: input order first, priority only breaks ties
+			if finalCfg.Interleave {
+				if buffer[i].lineNo != buffer[j].lineNo {
+					return buffer[i].lineNo < buffer[j].lineNo
+				}
+				return buffer[i].priority < buffer[j].priority
+			}
+			// --prior boosts move lines within the matched bands or within
+			// the unmatched band, never across the two
+			pi, pj := buffer[i].priority, buffer[j].priority
+			if pi != pj && (pi == unmatchedPriority || pj == unmatchedPriority) {
+				return pi < pj
+			}
+			if ki, kj := float64(pi)-buffer[i].boost, float64(pj)-buffer[j].boost; ki != kj {
+				return ki < kj
+			}
+			// --band-order input: arrival order inside a band, also among
+			// unmatched lines unless --unmatched-sort asks for another order
+			if finalCfg.BandOrder == "input" && (pi != unmatchedPriority || finalCfg.UnmatchedSort == "lexical") {
+				return buffer[i].lineNo < buffer[j].lineNo
+			}
+			// --json-sort-field and --sort-numeric-field: numbers ascending,
+			// lines without one last
+			if buffer[i].hasNum != buffer[j].hasNum {
+				return buffer[i].hasNum
+			}
+			if buffer[i].num != buffer[j].num {
+				return buffer[i].num < buffer[j].num
+			}
+			if buffer[i].clean == buffer[j].clean {
+				return finalCfg.FinalTie == "raw" && buffer[i].raw < buffer[j].raw
+			}
+			if buffer[i].priority == unmatchedPriority {
+				return unmatchedLess(buffer[i].clean, buffer[j].clean, finalCfg.UnmatchedSort)
+			}
+			return buffer[i].clean < buffer[j].clean
+		}
+		// Equal lines keep their input order unless --final-tie says otherwise
+		if finalCfg.FinalTie == "none" {
+			sort.Slice(buffer, less)
+		} else {
+			sort.SliceStable(buffer, less)
+		}
+		// Steps working on bands need the buffer in priority order
+		bandOrder := !finalCfg.Interleave && groupBy == nil
+		if finalCfg.UnmatchedSort == "newest" && bandOrder {
+			// Unmatched lines sort last and kept their input order
+			first := sort.Search(len(buffer), func(i int) bool { return buffer[i].priority == unmatchedPriority })
+			slices.Reverse(buffer[first:])
+		}
+		if finalCfg.MaxBands > 0 && bandOrder && collapseBands(buffer, finalCfg.MaxBands) && !bandsWarned {
+			warnf("More than %d priority bands, merging the rest into one (--max-bands)\n", finalCfg.MaxBands)
+			bandsWarned = true
+		}
+		if finalCfg.CompareCmd != "" && bandOrder {
+			compareBands(buffer, finalCfg.CompareCmd)
+		}
+		emit := buffer
+		var carry []item
+		if finalCfg.FlushCap > 0 && len(buffer) > finalCfg.FlushCap {
+			emit = buffer[:finalCfg.FlushCap]
+			if finalCfg.FlushCapCarry {
+				carry = append(carry, buffer[finalCfg.FlushCap:]...)
+			}
+		}
+		if pins != nil {
+			// Pinned lines lead every flush and aren't repeated below
+			pinned := pins.active(time.Now())
+			rest := slices.DeleteFunc(slices.Clone(emit), func(it item) bool { return pins.has(it.clean) })
+			emit = append(pinned, rest...)
+		}
+		if finalCfg.Limit > 0 && len(emit) > limitLeft {
+			emit = emit[:limitLeft]
+		}
+		if finalCfg.Align {
+			alignItems(emit, finalCfg.Delimiter)
+		}
+		// --flush-reverse turns what would be printed around, so --limit
+		// still keeps the top lines
+		if finalCfg.FlushReverse {
+			slices.Reverse(emit)
+		}
+		if finalCfg.FlushSeparator != "" && flushedOutput && len(emit) > 0 {
+			send(item{raw: finalCfg.FlushSeparator, marker: true})
+		}
+		if len(emit) > 0 {
+			flushedOutput = true
+		}
+		var group *filter
+		hidden := 0 // --collapse-unmatched, current run of unmatched lines
+		for _, it := range emit {
+			if finalCfg.CollapseUnmatched && it.priority == unmatchedPriority {
+				hidden++
+				continue
+			}
+			if hidden > 0 {
+				send(item{raw: collapsedMarker(finalCfg.CollapseText, hidden), marker: true})
+				hidden = 0
+			}
+			if it.match != nil && it.match != group && it.match.label != "" {
+				send(item{raw: it.match.label, marker: true})
+			}
+			group = it.match
+			send(it)
+		}
+		if hidden > 0 {
+			send(item{raw: collapsedMarker(finalCfg.CollapseText, hidden), marker: true})
+		}
+		fastGroup = nil
+		if finalCfg.FlushMarker != "" && len(emit) > 0 {
+			send(item{raw: finalCfg.FlushMarker, marker: true})
+		}
+		// Past --limit a flush may have nothing left to print
+		if len(emit) > 0 {
+			flushes++
+			if finalCfg.FlushEvents {
+				writeFlushEvent(os.Stderr, flushes, reason, emit)
+			}
+		}
+		buffer = append(buffer[:0], carry...)
+		prioritizedCount = 0
+		for _, it := range buffer {
+			if it.priority != unmatchedPriority {
+				prioritizedCount++
+			}
+		}
+		bufferBytes = bufferSize(buffer)
+		resetTicker(finalCfg.Timeout)
+	}
+
+	// flushAll flushes until --flush-cap-carry has nothing left over, for
+	// the end of the input or of a --repeat run
+	flushAll := func(reason string) {
+		flush(reason)
+		for len(buffer) > 0 {
+			flush(reason)
+		}
+	}
+
+	// buffered accounts for the line just added to buffer and enforces
+	// --max-memory: flush everything, or drop the lowest bands
+	buffered := func() {
+		bufferBytes += itemSize(buffer[len(buffer)-1])
+		if finalCfg.MaxMemory <= 0 || bufferBytes <= int64(finalCfg.MaxMemory) {
+			return
+		}
+		if finalCfg.MemoryPolicy == "flush" {
+			flush("memory")
+			return
+		}
+		var dropped int
+		buffer, bufferBytes, dropped = evictLowest(buffer, bufferBytes, int64(finalCfg.MaxMemory))
+		prioritizedCount = 0
+		for _, it := range buffer {
+			if it.priority != unmatchedPriority {
+				prioritizedCount++
+			}
+		}
+		if dropped > 0 && !evictWarned {
+			warnf("Buffer over --max-memory, dropping lowest-priority lines\n")
+			evictWarned = true
+		}
+	}
+
+	// adapt shortens the flush deadline with --adaptive-flush: bigger buffers
+	// get a shorter deadline, measured from the last flush
+	adapt := func() {
+		if !finalCfg.AdaptiveFlush || ticker == nil || len(buffer) == 0 {
+			return
+		}
+		remaining := adaptiveTimeout(finalCfg.Timeout, len(buffer)) - time.Since(lastFlush)
+		if remaining <= 0 {
+			flush("adaptive")
+		} else {
+			resetTicker(remaining)
+		}
+	}
+
+	headLeft := finalCfg.Head
+	headerPending := finalCfg.HeaderFields // --header-fields, names not read yet
+	if headerPending && headLeft == 0 {
+		headLeft = 1
+	}
+
+	// Counters for --stats
+	totalLines := 0
+	sampleCount := 0  // lines seen by --sample
+	sampledLines := 0 // lines --sample dropped, in no total
+	unmatchedLines := 0
+	filterCounts := make([]int, len(filters))
+	used := make([]bool, len(filters)) // --warn-unused, matched at least once
+	var picker *timedPicker
+	if finalCfg.FilterTimeout > 0 {
+		picker = newTimedPicker(filters, &finalCfg)
+	}
+
+	rates := make([]rateTracker, len(filters))
+	dedup := newDedupWindow(finalCfg.DedupWindow)
+
+	var freq *freqCounter
+	if finalCfg.MinFreq > 0 || finalCfg.DedupeByFingerprint {
+		freq = &freqCounter{index: map[string]int{}, latest: finalCfg.FingerprintSample == "last"}
+	}
+
+	var breaker *ratioWindow
+	tripped := false
+	if finalCfg.UnmatchedRatioLimit > 0 {
+		breaker = newRatioWindow(finalCfg.UnmatchedRatioWindow)
+	}
+
+	emittedLines := 0 // --count-lines
+
+	stickyIndex, stickyPriority := -1, 0
+
+	// --state-file: pins, burst counters and line frequencies of earlier
+	// runs. Pins and counters are picked up by filter spec, so an edited
+	// filter list still loads; frequencies feed the --prior boost.
+	var statePrior, seen map[string]int
+	if finalCfg.StateFile != "" {
+		st, err := readState(expand(finalCfg.StateFile))
+		if err != nil {
+			warnf("Ignoring --state-file: %v\n", err)
+		}
+		specs := map[string]int{}
+		for i := len(filters) - 1; i >= 0; i-- {
+			specs[filters[i].spec] = i
+		}
+		for _, p := range st.Pins {
+			if i, ok := specs[p.Filter]; ok && filters[i].pinned {
+				pins.lines[p.Clean] = pinnedLine{it: item{raw: p.Raw, clean: p.Clean, priority: p.Priority, match: &filters[i]}, seen: p.Seen}
+			}
+		}
+		for spec, times := range st.Rates {
+			if i, ok := specs[spec]; ok {
+				rates[i].times = times
+			}
+		}
+		statePrior, seen = st.Prior, map[string]int{}
+		if len(statePrior) > 0 && prior == nil {
+			prior = map[string]int{}
+		}
+		for key, n := range statePrior {
+			prior[key] += n
+			priorMax = max(priorMax, prior[key])
+		}
+	}
+
+	// With --state-file or --pid-file, SIGINT and SIGTERM end the run like
+	// EOF so the state still gets saved and the PID file removed
+	var stopCh chan os.Signal
+	if finalCfg.StateFile != "" || finalCfg.PidFile != "" {
+		stopCh = make(chan os.Signal, 1)
+		signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+	}
+
+	// --control-fd: control lines from an extra descriptor reach the event
+	// loop as filter lists, so swapping filters needs no locking
+	var controlCh chan []string
+	if finalCfg.ControlFd != 0 {
+		if finalCfg.ControlFd < 3 {
+			fmt.Fprintf(os.Stderr, "Invalid --control-fd %d: use 3 or above, 0-2 are stdin, stdout and stderr\n", finalCfg.ControlFd)
+			exit(1)
+		}
+		ctl := os.NewFile(uintptr(finalCfg.ControlFd), "control")
+		if _, err := ctl.Stat(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --control-fd %d: %v\n", finalCfg.ControlFd, err)
+			exit(1)
+		}
+		controlCh = make(chan []string)
+		go readControl(ctl, controlCh)
+	}
+	var headerCols map[string]int // --header-fields, for filters swapped in later
+
+	// SIGHUP re-reads the filters of the filter file; its option line and
+	// filters from elsewhere stay as they are
+	var hupCh chan os.Signal
+	if filterPath != "" {
+		hupCh = make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+	}
+	reloadFilters := func() ([]filter, int, error) {
+		content, err := os.ReadFile(filterPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		ff, err := parseFilterFile(strings.Split(string(content), "\n"), cliCfg.StrictFileArgs)
+		if err != nil {
+			return nil, 0, err
+		}
+		// The file's filters come first, the others move along with them
+		specs := append(slices.Clone(ff.specs), filterSpecs[fileSpecs:]...)
+		shift := len(ff.specs) - fileSpecs
+		nextLabels, nextBands, nextGuards := map[int]string{}, map[int]int{}, ff.guards
+		if finalCfg.EchoComments {
+			maps.Copy(nextLabels, ff.labels)
+		}
+		nextSources := map[int]string{}
+		for i, n := range ff.lines {
+			nextSources[i] = fmt.Sprintf("%s:%d", filterPath, n)
+		}
+		for i, src := range sources {
+			if i >= fileSpecs {
+				nextSources[i+shift] = src
+			}
+		}
+		for i, l := range labels {
+			if i >= fileSpecs {
+				nextLabels[i+shift] = l
+			}
+		}
+		for i, b := range bands {
+			if i >= fileSpecs {
+				nextBands[i+shift] = b
+			}
+		}
+		next, err := compileFilters(specs, nextLabels, nextBands, nextGuards, nextSources, &finalCfg)
+		if err != nil {
+			return nil, 0, err
+		}
+		score, err := weighFilters(next, &finalCfg)
+		return next, score, err
+	}
+
+	if finalCfg.PidFile != "" {
+		path := expand(finalCfg.PidFile)
+		if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing --pid-file: %v\n", err)
+			exit(1)
+		}
+		pidFile = path
+		defer removePidFile()
+	}
+
+	started := time.Now() // --brief
+
+	// finish drains the printers and reports; the loop returns right after
+	finish := func() {
+		if finalCfg.CountLines {
+			printCh <- item{raw: strconv.Itoa(emittedLines), marker: true}
+		}
+		close(printCh) // Signal printer to finish
+		<-printDone    // Wait for printer to finish
+		if unmatchedCh != nil {
+			close(unmatchedCh)
+		}
+		<-unmatchedDone
+		if finalCfg.Stats {
+			printStats(os.Stderr, filters, filterCounts, unmatchedLines, totalLines-sampledLines)
+		}
+		if finalCfg.WarnUnused {
+			for i, f := range filters {
+				if !used[i] {
+					warnf("Unused filter '%s' (priority %d): no line matched it\n", f.spec, i)
+				}
+			}
+		}
+		if finalCfg.StateFile != "" {
+			st := savedState{Version: stateVersion, Rates: map[string][]time.Time{}, Prior: mergeCounts(statePrior, seen, stateMaxLines)}
+			if pins != nil {
+				for _, pl := range pins.lines {
+					st.Pins = append(st.Pins, savedPin{Raw: pl.it.raw, Clean: pl.it.clean, Priority: pl.it.priority, Filter: pl.it.match.spec, Seen: pl.seen})
+				}
+			}
+			for i := range rates {
+				if len(rates[i].times) > 0 {
+					st.Rates[filters[i].spec] = rates[i].times
+				}
+			}
+			if err := writeState(expand(finalCfg.StateFile), st); err != nil {
+				warnf("Error writing --state-file: %v\n", err)
+			}
+		}
+		if finalCfg.Brief {
+			counted := totalLines - sampledLines
+			matched, pct := counted-unmatchedLines, 0
+			if counted > 0 {
+				pct = matched * 100 / counted
+			}
+			warnf("ssort: %d lines, %d matched (%d%%), %d flushes, %.1fs\n", counted, matched, pct, flushes, time.Since(started).Seconds())
+		}
+	}
+
+	// useFilters swaps in filters from --control-fd or a SIGHUP reload.
+	// Buffered lines keep their band; counters start over for the new set.
+	useFilters := func(next []filter, score int) {
+		filters, maxScore = next, score
+		filterCounts = make([]int, len(filters))
+		used = make([]bool, len(filters))
+		rates = make([]rateTracker, len(filters))
+		if picker != nil {
+			picker = newTimedPicker(filters, &finalCfg)
+		}
+		stickyIndex = -1
+		fastGroup = nil
+	}
+
+	// 7. Main Event Loop
+	var lines <-chan inputLine = linesCh
+	if finalCfg.Join > 0 || joinDelim != nil {
+		sep := " "
+		if !finalCfg.Flatten {
+			sep = "\n"
+		}
+		lines = joinLines(lines, finalCfg.Join, joinDelim, finalCfg.Color, sep)
+	}
+	if finalCfg.ReverseInput {
+		lines = reverseLines(lines)
+	}
+	var held []inputLine // --wait-backlog, lines seen before the gate opened
+	for {
+		if finalCfg.MaxFlushes > 0 && flushes >= finalCfg.MaxFlushes {
+			finish()
+			return
+		}
+		select {
+		case in, ok := <-lines:
+			if !ok {
+				switch {
+				case freq != nil && finalCfg.DedupeByFingerprint:
+					// Clusters come biggest first, not by band
+					for _, it := range freq.ranked(max(finalCfg.MinFreq, 1)) {
+						send(it)
+					}
+				case freq != nil:
+					buffer = append(buffer, freq.frequent(finalCfg.MinFreq)...)
+				}
+				flushAll("eof")
+				finish()
+				return
+			}
+
+			switch in.event {
+			case cycleStart:
+				printCh <- item{raw: clearScreen, control: true}
+				limitLeft = finalCfg.Limit
+				gate.reset()
+				continue
+			case cycleEnd:
+				flushAll("cycle")
+				continue
+			}
+
+			// --wait-for is a one-way latch: lines before the first match are
+			// dropped, or replayed once it matches with --wait-backlog
+			if waitFor != nil {
+				text := in.text
+				if finalCfg.Color {
+					text = ansiRegex.ReplaceAllString(text, "")
+				}
+				if !waitFor.MatchString(text) {
+					if finalCfg.WaitBacklog {
+						held = append(held, in)
+					}
+					continue
+				}
+				waitFor = nil
+				if len(held) > 0 {
+					lines = replayLines(append(held, in), lines)
+					held = nil
+					continue
+				}
+			}
+
+			line := in.text
+			totalLines++
+
+			// --idle-flush: the timeout counts from the latest line, so only
+			// a quiet input flushes
+			if finalCfg.IdleFlush {
+				resetTicker(flushPeriod())
+			}
+
+			// Header lines bypass matching and sorting entirely
+			if headLeft > 0 {
+				headLeft--
+				if headerPending {
+					headerPending = false
+					header := line
+					if finalCfg.Color {
+						header = ansiRegex.ReplaceAllString(header, "")
+					}
+					columns := headerColumns(header, finalCfg.Delimiter)
+					headerCols = columns
+					if err := resolveFieldNames(filters, columns); err != nil {
+						fmt.Fprintf(os.Stderr, "--header-fields: %v\n", err)
+						exit(1)
+					}
+					if sortFieldName != "" {
+						if sortField = columns[sortFieldName]; sortField == 0 {
+							fmt.Fprintf(os.Stderr, "--header-fields: no field '%s' for --sort-numeric-field in the header\n", sortFieldName)
+							exit(1)
+						}
+					}
+				}
+				if finalCfg.CountLines {
+					emittedLines++
+					continue
+				}
+				send(item{raw: line, clean: line, lineNo: totalLines, offset: in.offset})
+				continue
+			}
+
+			cleanLine := line
+			if finalCfg.Color {
+				cleanLine = ansiRegex.ReplaceAllString(line, "")
+			}
+			// --trip: print what's buffered, then the line, and exit
+			if trip != nil && trip.MatchString(cleanLine) {
+				flush("trip")
+				send(item{raw: line, clean: cleanLine, lineNo: totalLines, offset: in.offset})
+				finish()
+				exit(finalCfg.TripCode)
+			}
+			// --sample: only every Nth line goes on, or each one with chance
+			// 1/N; --sample-keep-matches lets the others on if they match
+			sampledOut := false
+			if finalCfg.Sample > 1 {
+				sampleCount++
+				if finalCfg.SampleRandom {
+					sampledOut = rand.IntN(finalCfg.Sample) != 0
+				} else {
+					sampledOut = sampleCount%finalCfg.Sample != 0
+				}
+				if sampledOut && !finalCfg.SampleKeepMatches {
+					sampledLines++
+					continue
+				}
+			}
+			if finalCfg.URLDecode {
+				// Invalid encodings are left as they are
+				if decoded, err := url.QueryUnescape(cleanLine); err == nil {
+					cleanLine = decoded
+				}
+			}
+			if transform != nil {
+				cleanLine = transform.apply(cleanLine)
+			}
+			var num float64
+			hasNum := false
+			if finalCfg.JSONSortField != "" {
+				num, hasNum = jsonNumber(cleanLine, finalCfg.JSONSortField)
+			} else if sortField > 0 {
+				num, hasNum = fieldNumber(cleanLine, finalCfg.Delimiter, sortField)
+			}
+			var group string
+			grouped := false
+			if groupBy != nil {
+				group, grouped = lineKey(cleanLine, groupBy)
+			}
+			// Filters and sorting may each see the line case folded
+			matchText, sortText := cleanLine, cleanLine
+			if finalCfg.MatchCase == "fold" || finalCfg.SortCase == "fold" {
+				folded := lowerCase(cleanLine)
+				if finalCfg.MatchCase == "fold" {
+					matchText = folded
+				}
+				if finalCfg.SortCase == "fold" {
+					sortText = folded
+				}
+			}
+			if finalCfg.DropEmpty && strings.TrimSpace(cleanLine) == "" {
+				continue
+			}
+			if n := textLen(cleanLine, finalCfg.Runes); n < finalCfg.MinLineLength || finalCfg.MaxLineLength > 0 && n > finalCfg.MaxLineLength {
+				continue
+			}
+			if matchesAny(excludes, matchText) {
+				continue
+			}
+			// --fingerprint collapses variable parts so similar lines share a
+			// sort and dedup key
+			sortKey := sortText
+			if fingerprint != nil {
+				sortKey = fingerprint.ReplaceAllString(sortText, fingerprintPlaceholder)
+			}
+			if finalCfg.DedupWindow > 0 {
+				if key, ok := lineKey(sortKey, dedupKey); ok && dedup.seen(key, time.Now()) {
+					continue
+				}
+			}
+			if seen != nil && (seen[sortKey] > 0 || len(seen) < stateMaxLines) {
+				seen[sortKey]++
+			}
+
+			// --prior: the more often a line showed up last time, the closer
+			// it moves to --prior-weight bands up
+			boost := 0.0
+			if n := prior[sortKey]; n > 0 {
+				boost = finalCfg.PriorWeight * float64(n) / float64(priorMax)
+			}
+
+			// Filters see the reversed line with --match-reversed; output and
+			// sort key stay forward
+			matchLine := matchText
+			if finalCfg.MatchReversed {
+				matchLine = reverseRunes(matchText)
+			}
+
+			var matchedIndex, score int
+			if picker != nil {
+				var ok bool
+				if matchedIndex, score, ok = picker.pick(matchLine); !ok {
+					warnf("Line %d: filters took over %v, treating it as unmatched\n", totalLines, finalCfg.FilterTimeout)
+				}
+			} else {
+				matchedIndex, score = pickFilter(filters, matchLine, &finalCfg)
+			}
+
+			// Unmatched lines --sample-keep-matches drops below aren't counted
+			if matchedIndex != -1 {
+				filterCounts[matchedIndex]++
+			} else if !sampledOut {
+				unmatchedLines++
+			}
+
+			// --warn-unused also counts filters that matched but lost the
+			// tie-break; only the ones still unused are tried
+			if finalCfg.WarnUnused && matchedIndex != -1 {
+				used[matchedIndex] = true
+				for i := range filters {
+					if !used[i] {
+						used[i], _ = filters[i].match(matchLine)
+					}
+				}
+			}
+
+			// --match-report tries every filter, not only up to the winner
+			report := ""
+			if finalCfg.MatchReport && matchedIndex != -1 {
+				report = matchReport(filters, matchLine)
+			}
+			var all []filter // --highlight-all colors them at output
+			if finalCfg.HighlightAll && matchedIndex != -1 {
+				all = filters
+			}
+
+			// The band is the winning filter, or with --score the distance
+			// from the best possible score. A priority= filter line fixes it.
+			priority := matchedIndex
+			if finalCfg.Score && matchedIndex != -1 {
+				priority = maxScore - score
+			} else if matchedIndex != -1 && filters[matchedIndex].fixedBand {
+				priority = filters[matchedIndex].band
+			}
+
+			// --sticky-priority: unmatched lines inherit the band of the last
+			// match until a blank line
+			if finalCfg.StickyPriority {
+				switch {
+				case matchedIndex != -1:
+					stickyIndex, stickyPriority = matchedIndex, priority
+				case strings.TrimSpace(cleanLine) == "":
+					stickyIndex = -1
+				case stickyIndex != -1:
+					matchedIndex, priority = stickyIndex, stickyPriority
+				}
+			}
+
+			if len(shifts) > 0 && matchedIndex != -1 {
+				priority = shiftBand(priority, shifts, matchLine, lastBand(filters, &finalCfg, maxScore))
+			}
+
+			// A filter matching more than --rate-threshold times within
+			// --rate-window is bursting: its lines jump to the top
+			if finalCfg.RateWindow > 0 && matchedIndex != -1 {
+				if rates[matchedIndex].hit(time.Now(), finalCfg.RateWindow, finalCfg.RateThreshold) {
+					priority = 0
+				}
+			}
+
+			matched := matchedIndex != -1
+
+			// --min-fields: malformed records go straight to the top
+			if finalCfg.MinFields > 0 && len(splitFields(cleanLine, finalCfg.Delimiter)) < finalCfg.MinFields {
+				matched, priority = true, 0
+			}
+
+			if sampledOut && !matched {
+				sampledLines++
+				continue
+			}
+
+			// --unmatched-ratio-limit: a mostly unmatched stream trips the
+			// breaker for good, unmatched lines are dropped from then on
+			if breaker != nil && !tripped && breaker.add(!matched) > finalCfg.UnmatchedRatioLimit {
+				tripped = true
+				warnf("Unmatched lines exceed %g of the last %d, dropping unmatched lines\n", finalCfg.UnmatchedRatioLimit, finalCfg.UnmatchedRatioWindow)
+				buffer = slices.DeleteFunc(buffer, func(it item) bool { return it.priority == unmatchedPriority })
+				bufferBytes = bufferSize(buffer)
+			}
+
+			var winner *filter
+			if matchedIndex != -1 {
+				winner = &filters[matchedIndex]
+			}
+
+			// --only-capture prints the capture group instead of the line; the
+			// sort key stays the whole line
+			if finalCfg.OnlyCapture > 0 {
+				if c, ok := captureGroup(line, winner, finalCfg.OnlyCapture, finalCfg.Color); ok {
+					line = c
+				} else if finalCfg.CaptureFallback == "drop" {
+					continue
+				}
+			}
+
+			// --count-lines only counts what would reach stdout
+			if finalCfg.CountLines {
+				if matched || (!finalCfg.OnlyMatching && !finalCfg.DropUnmatched && unmatchedCh == nil) {
+					emittedLines++
+				}
+				continue
+			}
+
+			// --min-freq holds everything back and counts it, printing the
+			// frequent lines at EOF
+			if freq != nil {
+				if matched || !(finalCfg.OnlyMatching || finalCfg.DropUnmatched || tripped) {
+					p := priority
+					if !matched {
+						p = unmatchedPriority
+					}
+					freq.add(item{raw: line, clean: sortKey, priority: p, match: winner, lineNo: totalLines, offset: in.offset, report: report, all: all})
+				}
+				continue
+			}
+
+			if winner != nil && winner.pinned {
+				pins.add(item{raw: line, clean: sortKey, priority: priority, match: winner, lineNo: totalLines, offset: in.offset, report: report, all: all}, time.Now())
+			}
+
+			// --buffer-source: lines of the other source go out like --no-sort
+			streamed := finalCfg.BufferSource == "stdin" && in.exec ||
+				finalCfg.BufferSource == "exec" && !in.exec
+
+			// Case A: Highest Priority (or everything matched with --no-sort)
+			if matched && (priority == 0 && !finalCfg.Canonical || finalCfg.NoSort || streamed) {
+				if winner != nil && winner != fastGroup && winner.label != "" {
+					send(item{raw: winner.label, marker: true})
+				}
+				fastGroup = winner
+				send(item{raw: line, clean: sortKey, priority: priority, match: winner, lineNo: totalLines, offset: in.offset, report: report, all: all})
+				// The buffered matches may be enough to use up what's left
+				if finalCfg.Limit > 0 && prioritizedCount > 0 && prioritizedCount >= limitLeft {
+					flush("limit")
+				}
+				continue
+			}
+
+			// Case B: Unmatched
+			if !matched {
+				if finalCfg.DropUnmatched || tripped {
+					continue
+				}
+				if unmatchedCh != nil {
+					unmatchedCh <- line
+					continue
+				}
+				if finalCfg.OnlyMatching {
+					continue
+				}
+				if finalCfg.Keep || finalCfg.NoSort || streamed {
+					send(item{raw: line, clean: sortKey, priority: unmatchedPriority, kept: true, lineNo: totalLines, offset: in.offset})
+				} else {
+					buffer = append(buffer, item{raw: line, clean: sortKey, priority: unmatchedPriority, lineNo: totalLines, offset: in.offset, boost: boost, num: num, hasNum: hasNum, group: group, grouped: grouped})
+					buffered()
+					adapt()
+				}
+				continue
+			}
+
+			// Case C: Buffered
+			buffer = append(buffer, item{raw: line, clean: sortKey, priority: priority, match: winner, lineNo: totalLines, offset: in.offset, report: report, all: all, boost: boost, num: num, hasNum: hasNum, group: group, grouped: grouped})
+			prioritizedCount++
+			buffered()
+
+			if finalCfg.Limit > 0 && prioritizedCount >= limitLeft {
+				flush("limit")
+			} else if priority <= finalCfg.FlushOnPriority {
+				flush("priority")
+			}
+			adapt()
+
+		case <-tickCh:
+			flush("timeout")
+		case specs := <-controlCh:
+			next, err := compileFilterList(specs, &finalCfg)
+			if err == nil && headerCols != nil {
+				err = resolveFieldNames(next, headerCols)
+			}
+			if err != nil {
+				warnf("Ignoring @filters: %v\n", err)
+				continue
+			}
+			score := 0
+			for i := range next {
+				score += next[i].weight
+			}
+			useFilters(next, score)
+		case <-hupCh:
+			next, score, err := reloadFilters()
+			if err == nil && headerCols != nil {
+				err = resolveFieldNames(next, headerCols)
+			}
+			if err != nil {
+				warnf("Ignoring SIGHUP reload: %v\n", err)
+				continue
+			}
+			useFilters(next, score)
+		case <-stopCh:
+			flush("signal")
+			finish()
+			return
+		}
+	}
+}
+
+// Helpers
+
+func defineFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Filters, "f", "", "Comma separated list of prioritized strings")
+	fs.BoolVar(&c.OnlyMatching, "o", false, "Output only matching results")
+	fs.BoolVar(&c.Keep, "k", false, "")
+	fs.BoolVar(&c.Keep, "keep-going", false, "Output unsorted (unmatched) lines immediately")
+	fs.BoolVar(&c.IgnoreCase, "i", false, "")
+	fs.BoolVar(&c.IgnoreCase, "ignore-case", false, "Ignore case")
+	fs.IntVar(&c.Limit, "limit", 0, "Flush buffer after N prioritized matches")
+	fs.DurationVar(&c.Timeout, "timeout", defaultTimeout, "Flush timeout; SSORT_TIMEOUT sets the default")
+	fs.BoolVar(&c.Color, "color", false, "Enable color-aware mode")
+	fs.BoolVar(&c.WordBoundary, "w", false, "Match on word boundaries only")
+	fs.StringVar(&c.WordBoundaryMode, "word-boundary-mode", "ascii", "Word characters for -w: ascii, unicode or segment")
+	fs.BoolVar(&c.VersionFlag, "version", false, "Display version and quit")
+	fs.BoolVar(&c.VersionJSON, "version-json", false, "Display version information as JSON and quit")
+	fs.BoolVar(&c.ColorTest, "color-test", false, "Print sample lines using ssort's colors and hyperlinks and quit")
+	fs.StringVar(&c.Exec, "e", "", "Execute command and sort its output")
+	fs.IntVar(&c.TailLines, "tail-lines", 0, "Only process the last N input lines (waits for EOF)")
+	fs.BoolVar(&c.URLDecode, "url-decode", false, "Match and sort on URL-decoded lines")
+	fs.IntVar(&c.Head, "head", 0, "Emit the first N lines verbatim before sorting the rest")
+	fs.StringVar(&c.UnmatchedOut, "unmatched-file", "", "Write unmatched lines to this file instead of stdout")
+	fs.BoolVar(&c.AdaptiveFlush, "adaptive-flush", false, "Shorten the flush timeout as the buffer grows")
+	fs.BoolVar(&c.DropEmpty, "drop-empty", false, "Drop lines that are blank (after color stripping)")
+	fs.StringVar(&c.TieBreak, "tie-break", "longest", "Winner when several filters match: longest, firstlisted or lastlisted")
+	fs.IntVar(&c.FlushCap, "flush-cap", 0, "Emit at most N lines per flush, keeping the highest priority")
+	fs.BoolVar(&c.FlushCapCarry, "flush-cap-carry", false, "Carry lines over --flush-cap to the next flush instead of dropping them")
+	fs.Var(&c.Exclude, "exclude", "Comma separated list of strings; matching lines are dropped (repeatable)")
+	fs.BoolVar(&c.MatchReversed, "match-reversed", false, "Match filters against the reversed line")
+	fs.StringVar(&c.ExecStderr, "exec-stderr", "separate", "What to do with -e command stderr: merge, separate or drop")
+	fs.BoolVar(&c.Deterministic, "deterministic", false, "Disable time-based flushing (flush only on --limit and EOF)")
+	fs.BoolVar(&c.Stats, "stats", false, "Print per-filter match statistics to stderr at EOF")
+	fs.BoolVar(&c.QuietErrors, "quiet-errors", false, "Suppress non-fatal errors and -e command stderr")
+	fs.StringVar(&c.FlushMarker, "flush-marker", "", "Line to emit after each non-empty flush")
+	fs.BoolVar(&c.IgnoreFilterErrors, "ignore-filter-errors", false, "Skip filters that fail to compile instead of exiting")
+	fs.BoolVar(&c.Score, "score", false, "Prioritize by the summed weight of all matching filters")
+	fs.StringVar(&c.Weights, "weights", "", "Comma separated filter weights for --score (in filter order)")
+	fs.IntVar(&c.InputBuffer, "input-buffer-size", 100, "Lines buffered between reader and sorter (0 = unbuffered)")
+	fs.StringVar(&c.Delimiter, "d", "", "")
+	fs.StringVar(&c.Delimiter, "delimiter", "", "Field delimiter for field filters (default: whitespace)")
+	fs.BoolVar(&c.NoSort, "no-sort", false, "Keep input order: emit every line immediately")
+	fs.BoolVar(&c.Highlight, "highlight", false, "Highlight the winning filter's matches in output")
+	fs.DurationVar(&c.Repeat, "repeat", 0, "Re-run the -e command every interval, redrawing the screen")
+	fs.StringVar(&c.CompareCmd, "compare-cmd", "", "Command that orders the lines within each priority band")
+	fs.DurationVar(&c.RateWindow, "rate-window", 0, "Window for burst detection with --rate-threshold")
+	fs.IntVar(&c.RateThreshold, "rate-threshold", 10, "Matches of one filter within --rate-window that make it top priority")
+	fs.StringVar(&c.StdinSplit, "stdin-split", "", "Read filters from stdin up to this sentinel line, then input")
+	fs.BoolVar(&c.CountLines, "count-lines", false, "Only print the number of lines that would be output")
+	fs.BoolVar(&c.Hyperlinks, "hyperlinks", false, "Turn file:line references in matched lines into terminal hyperlinks (TTY only)")
+	fs.BoolVar(&c.StickyPriority, "sticky-priority", false, "Unmatched lines keep the priority of the last match until a blank line")
+	fs.BoolVar(&c.Align, "align", false, "Align fields in columns within each flush")
+	fs.BoolVar(&c.DropUnmatched, "drop-unmatched", false, "Discard unmatched lines as soon as they arrive")
+	fs.IntVar(&c.MinFields, "min-fields", 0, "Give top priority to lines with fewer than N fields (see -d)")
+	fs.BoolVar(&c.ShowKey, "show-key", false, "Prefix each line with its sort key (priority:clean line)")
+	fs.IntVar(&c.MaxFlushes, "max-flushes", 0, "Exit after N non-empty flushes")
+	fs.BoolVar(&c.Runes, "runes", false, "Measure lengths in runes instead of bytes")
+	fs.BoolVar(&c.Syslog, "syslog", false, "Send output to the local syslog instead of stdout")
+	fs.StringVar(&c.SyslogTag, "syslog-tag", "ssort", "Tag for --syslog messages")
+	fs.BoolVar(&c.EchoComments, "echo-comments", false, "Print filter file comments above the group of the filter they precede")
+	fs.DurationVar(&c.DedupWindow, "dedup-window", 0, "Drop lines whose key was seen within this window")
+	fs.StringVar(&c.DedupKey, "dedup-key", "", "Regexp selecting the --dedup-window key (first group or whole match; default whole line)")
+	fs.StringVar(&c.UnmatchedSort, "unmatched-sort", "lexical", "Order of unmatched lines: lexical, numeric, reverse, arrival or newest")
+	fs.BoolVar(&c.AlwaysExitZero, "always-exit-zero", false, "Exit with status 0 even after errors")
+	fs.BoolVar(&c.Transitions, "transitions", false, "Only print lines whose priority differs from the previous line's")
+	fs.StringVar(&c.FilterDir, "filter-dir", "", "Read filters from every file in this directory, in file name order")
+	fs.StringVar(&c.TrimPrefix, "trim-prefix", "", "Regexp removed from the start of printed lines")
+	fs.StringVar(&c.TrimSuffix, "trim-suffix", "", "Regexp removed from the end of printed lines")
+	fs.StringVar(&c.KeepLabel, "keep-label", "", "Prefix for unmatched lines printed immediately by -k")
+	fs.IntVar(&c.MinLineLength, "min-line-length", 0, "Drop lines shorter than N (see --runes)")
+	fs.IntVar(&c.MaxLineLength, "max-line-length", 0, "Drop lines longer than N (0 = no limit)")
+	fs.IntVar(&c.OnlyCapture, "only-capture", 0, "Print capture group N of the winning regexp filter instead of the line")
+	fs.StringVar(&c.CaptureFallback, "capture-fallback", "line", "Lines without the --only-capture group: line (print it) or drop")
+	fs.Float64Var(&c.UnmatchedRatioLimit, "unmatched-ratio-limit", 0, "Drop unmatched lines for good once their fraction of the window exceeds this (0-1)")
+	fs.IntVar(&c.UnmatchedRatioWindow, "unmatched-ratio-window", 1000, "Lines in the --unmatched-ratio-limit window")
+	fs.StringVar(&c.SplitDir, "split-dir", "", "Write each priority band to its own file in this directory")
+	fs.BoolVar(&c.SplitTee, "split-tee", false, "With --split-dir, still print everything to stdout")
+	fs.BoolVar(&c.NoFinalNewline, "no-final-newline", false, "Don't end the output with a newline")
+	fs.StringVar(&c.Fingerprint, "fingerprint", "", "Regexp for variable parts; lines sort and dedup by the line with them replaced")
+	fs.StringVar(&c.FinalTie, "final-tie", "input", "Order of lines with equal priority and key: input, raw or none")
+	fs.IntVar(&c.MinFreq, "min-freq", 0, "At EOF, print each line seen at least N times once, with its count")
+	fs.Var(&c.ExecEnv, "exec-env", "KEY=VALUE added to the -e command's environment (repeatable)")
+	fs.StringVar(&c.ExecDir, "exec-dir", "", "Working directory for the -e command")
+	fs.BoolVar(&c.PriorityZeroWins, "priority-zero-wins", false, "Stop scanning filters once the first one matches, even if a later one is longer")
+	fs.BoolVar(&c.FlushEvents, "flush-events", false, "Write a JSON line to stderr for every flush")
+	fs.BoolVar(&c.IdleFlush, "idle-flush", false, "Flush only after the input has been idle for --timeout")
+	fs.DurationVar(&c.PinTTL, "pin-ttl", time.Minute, "Drop a pinned line not seen for this long (0 = never)")
+	fs.IntVar(&c.Rate, "rate", 0, "Print at most N lines per second")
+	fs.StringVar(&c.RateOverflow, "rate-overflow", "drop", "Lines over --rate: drop or buffer (wait)")
+	fs.StringVar(&c.TransformCmd, "transform-cmd", "", "Command that rewrites each line (one in, one out) for matching and sorting")
+	fs.IntVar(&c.MaxBands, "max-bands", 0, "Merge matched lines past the first N priority bands of a flush into one band")
+	fs.StringVar(&c.Prefix, "prefix", "", "String prepended to every printed line")
+	fs.StringVar(&c.PrefixColor, "prefix-color", "", "SGR color for --prefix, e.g. 36 or 1;35")
+	fs.BoolVar(&c.Squeeze, "squeeze", false, "Collapse consecutive identical output lines into one")
+	fs.DurationVar(&c.Heartbeat, "heartbeat", 0, "Write --heartbeat-text to stderr after this long without output (e.g. 30s)")
+	fs.StringVar(&c.HeartbeatText, "heartbeat-text", "# ssort alive {time}", "Heartbeat line, {time} is replaced with the current time")
+	fs.BoolVar(&c.PriorityWins, "priority-wins", false, "The earliest matching filter wins regardless of match length (same as --tie-break firstlisted)")
+	fs.StringVar(&c.OutputRing, "output-ring", "", "Also write output to this file, keeping only the last --ring-size lines")
+	fs.IntVar(&c.RingSize, "ring-size", 1000, "Lines kept in the --output-ring file")
+	fs.BoolVar(&c.StrictFileArgs, "strict-file-args", false, "Filter file uses [options] and [filters] section headers (command line only)")
+	fs.BoolVar(&c.ByMatchCount, "by-match-count", false, "Rank lines by how many distinct filters they match")
+	fs.BoolVar(&c.BinarySafe, "binary-safe", false, "Keep input bytes as read: no carriage return stripping, -i leaves invalid UTF-8 alone")
+	fs.DurationVar(&c.InitialDelay, "initial-delay", 0, "Timeout for the first flush only, letting more lines collect before the first output")
+	fs.StringVar(&c.JSONSortField, "json-sort-field", "", "Order lines within a band by this numeric JSON field (dot path, e.g. req.duration_ms)")
+	fs.StringVar(&c.MatchCase, "match-case", "", "Case handling for matching: preserve or fold (default fold with -i, otherwise preserve)")
+	fs.StringVar(&c.SortCase, "sort-case", "", "Case handling for sorting: preserve or fold (default fold with -i, otherwise preserve)")
+	fs.StringVar(&c.FlushSeparator, "flush-separator", "", "Line to emit between non-empty flushes (not before the first or after the last)")
+	fs.BoolVar(&c.Brief, "brief", false, "Print a one-line summary (lines, matches, flushes, time) to stderr at EOF")
+	fs.BoolVar(&c.Interleave, "interleave", false, "Keep input order within each flush, matched and unmatched lines interleaved")
+	fs.StringVar(&c.Prior, "prior", "", "Earlier output file; lines that were frequent there sort slightly higher")
+	fs.Float64Var(&c.PriorWeight, "prior-weight", 0.5, "Bands the most frequent --prior line moves up by (below 1 only reorders within a band)")
+	fs.BoolVar(&c.WarnUnused, "warn-unused", false, "List filters that never matched a line on stderr at EOF")
+	fs.BoolVar(&c.Stdin, "stdin", false, "Read stdin as input even with -e, merging both")
+	fs.BoolVar(&c.StreamMatches, "stream-matches", false, "Print matching lines as they arrive, unsorted (same as -o --no-sort)")
+	fs.Var(&c.LimitBytes, "limit-bytes", "Stop printing once this many bytes were written (K, M and G suffixes allowed)")
+	fs.StringVar(&c.ByteCut, "byte-cut", "line", "Line that would cross --limit-bytes: line (leave it out) or exact (cut it at the limit)")
+	fs.BoolVar(&c.WordUnicode, "word-unicode", false, "Whole-word matching with Unicode word segmentation (same as -w --word-boundary-mode segment)")
+	fs.StringVar(&c.StateFile, "state-file", "", "Keep pins, burst counters and line frequencies in this file across runs")
+	fs.StringVar(&c.GroupBy, "group-by", "", "Regexp whose first group (or match) groups the lines of each flush")
+	fs.StringVar(&c.GroupOrder, "group-order", "first-seen", "Order of --group-by groups: first-seen, size or lexical")
+	fs.BoolVar(&c.CollapseUnmatched, "collapse-unmatched", false, "Replace each run of unmatched lines in a flush with a marker line")
+	fs.StringVar(&c.CollapseText, "collapse-text", "... {count} unmatched lines ...", "Marker for --collapse-unmatched, {count} is replaced with the run length")
+	fs.StringVar(&c.WaitFor, "wait-for", "", "Regexp gating the output: lines are dropped until one matches it")
+	fs.BoolVar(&c.WaitBacklog, "wait-backlog", false, "Keep the lines seen before --wait-for matched instead of dropping them")
+	fs.IntVar(&c.ContextChars, "context-chars", 0, "Print only the match and this many characters around it of matched lines (0 = whole line)")
+	fs.StringVar(&c.SortNumericField, "sort-numeric-field", "", "Order lines within a band by the number in this field (1-based or a --header-fields name, split like -d)")
+	fs.StringVar(&c.Recolor, "recolor", "", "SGR color for every printed line, replacing its own colors with --color, e.g. 33")
+	fs.IntVar(&c.Join, "join", 0, "Match and sort records of this many input lines instead of single lines")
+	fs.StringVar(&c.JoinDelimiter, "join-delimiter", "", "Regexp starting a new record at each line it matches (with or without --join)")
+	fs.BoolVar(&c.Flatten, "flatten", true, "Print --join records as one line; with --flatten=false as their original lines")
+	fs.BoolVar(&c.TeeStderr, "tee-stderr", false, "Also write the output to stderr")
+	fs.StringVar(&c.Format, "format", "", "Go text/template for each printed line, e.g. '{{.Priority}} {{.Line}}'")
+	fs.StringVar(&c.Trip, "trip", "", "Regexp: at the first line matching it, flush, print the line and exit with --trip-code")
+	fs.IntVar(&c.TripCode, "trip-code", 1, "Exit status for --trip")
+	fs.BoolVar(&c.DedupeByFingerprint, "dedupe-by-fingerprint", false, "At EOF, print one line per --fingerprint template with its count, most frequent first")
+	fs.StringVar(&c.FingerprintSample, "fingerprint-sample", "first", "Line shown for each template: first or last seen")
+	fs.Var(&c.MaxMemory, "max-memory", "Cap the buffered lines at about this many bytes (K, M and G suffixes allowed)")
+	fs.StringVar(&c.MemoryPolicy, "memory-policy", "flush", "Over --max-memory: flush the buffer, or evict the lowest-priority lines")
+	fs.BoolVar(&c.Passthrough, "passthrough", false, "Without filters, pass the input through unsorted (byte for byte if no other flag changes it)")
+	fs.BoolVar(&c.ReverseInput, "reverse-input", false, "Read all input, then process it last line first")
+	fs.BoolVar(&c.ByteOffsets, "byte-offsets", false, "Prefix lines with their byte offset in the input file (ssort < file)")
+	fs.DurationVar(&c.FilterTimeout, "filter-timeout", 0, "Treat a line as unmatched if its filters take longer than this (0 = no limit)")
+	fs.BoolVar(&c.HeaderFields, "header-fields", false, "Emit the first line as a header and let field filters use its names")
+	fs.BoolVar(&c.MatchReport, "match-report", false, "Append every filter a line matches, not just the winner, e.g. {ERROR,db}")
+	fs.BoolVar(&c.FlushReverse, "flush-reverse", false, "Print each flush bottom to top, highest priority last")
+	fs.StringVar(&c.BufferSource, "buffer-source", "all", "Input that is buffered and sorted: stdin, exec or all; the other streams through as with --no-sort")
+	fs.BoolVar(&c.DryMatch, "dry-match", false, "Print lines in input order, each with [priority=N filter=X]")
+	fs.Var(&c.Demote, "demote", "Comma separated filters; matched lines also matching one move down a band, or N with pattern@N (repeatable)")
+	fs.Var(&c.Promote, "promote", "Comma separated filters; matched lines also matching one move up a band, or N with pattern@N (repeatable)")
+	fs.StringVar(&c.InputEncoding, "input-encoding", "", "Charset of the input, e.g. latin1 or Shift_JIS (default UTF-8)")
+	fs.StringVar(&c.OutputEncoding, "output-encoding", "", "Charset to write output in (default UTF-8)")
+	fs.StringVar(&c.BandOrder, "band-order", "content", "Order of lines within a band: content (sorted) or input (arrival order)")
+	fs.IntVar(&c.ControlFd, "control-fd", 0, "Read control lines such as '@filters ERROR,WARN' from this file descriptor (3 or above)")
+	fs.BoolVar(&c.Canonical, "canonical", false, "Byte-identical output for identical input: buffer everything until EOF and order ties fully")
+	fs.IntVar(&c.FlushOnPriority, "flush-on-priority", -1, "Flush as soon as a line of this band or a higher one is buffered (-1 = off)")
+	fs.StringVar(&c.PidFile, "pid-file", "", "Write the process ID to this file while running")
+	fs.StringVar(&c.SourceOrder, "source-order", "interleaved", "With -e and --stdin: interleaved, stdin-first or exec-first")
+	fs.BoolVar(&c.HighlightAll, "highlight-all", false, "Highlight the matches of every matching filter, each filter in its own color")
+	fs.IntVar(&c.Truncate, "truncate", 0, "Cut printed lines to this many characters, ending in … (0 = no limit)")
+	fs.StringVar(&c.Watch, "watch", "", "Read this file, and again whenever it changes, redrawing the screen")
+	fs.DurationVar(&c.WatchInterval, "watch-interval", time.Second, "How often --watch checks the file for changes")
+	fs.IntVar(&c.Sample, "sample", 0, "Only let every Nth line through (0 = all lines)")
+	fs.BoolVar(&c.SampleRandom, "sample-random", false, "With --sample, let each line through with probability 1/N instead")
+	fs.BoolVar(&c.SampleKeepMatches, "sample-keep-matches", false, "With --sample, never drop lines that match a filter")
+}
+
+// applyFileConfig copies the flags set on the filter file's option line to
+// dst, except those the command line set
+func applyFileConfig(dst *Config, fileFs *flag.FlagSet, cliSet map[string]bool) {
+	// Flags bound to dst; defining them resets dst to the defaults, so it's
+	// put back afterwards
+	saved := *dst
+	dstFs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	defineFlags(dstFs, dst)
+	*dst = saved
+
+	// Aliases share a value, so -k on the command line also keeps
+	// --keep-going in the file from applying
+	cliVals := make(map[flag.Value]bool)
+	for name := range cliSet {
+		if f := dstFs.Lookup(name); f != nil {
+			cliVals[f.Value] = true
+		}
+	}
+	fileFs.Visit(func(f *flag.Flag) {
+		df := dstFs.Lookup(f.Name)
+		if cliVals[df.Value] {
+			return
+		}
+		// Repeatable flags are copied value by value, joined they could
+		// split differently
+		if l, ok := f.Value.(*listFlag); ok {
+			for _, v := range *l {
+				df.Value.Set(v)
+			}
+			return
+		}
+		df.Value.Set(f.Value.String())
+	})
+}
+
+// validateConfig checks the option values that stand on their own: the
+// choices a flag takes, its range, and flags that can't be combined. Checks
+// that need a pattern compiled or the filters stay where those are made.
+func validateConfig(c *Config) error {
+	if c.Repeat > 0 && c.Exec == "" {
+		return fmt.Errorf("--repeat requires a command (-e)")
+	}
+	// --watch is its own input and its own --repeat
+	if c.Watch != "" {
+		for _, o := range []struct {
+			set  bool
+			flag string
+		}{{c.Exec != "", "-e"}, {c.Stdin, "--stdin"}, {c.Repeat > 0, "--repeat"}} {
+			if o.set {
+				return fmt.Errorf("--watch conflicts with %s", o.flag)
+			}
+		}
+		if c.WatchInterval <= 0 {
+			return fmt.Errorf("Invalid --watch-interval %v: must be positive", c.WatchInterval)
+		}
+	}
+	// Stdin can only be read once, every --repeat run would wait on it
+	if c.Repeat > 0 && c.Stdin {
+		return fmt.Errorf("--stdin can't be combined with --repeat")
+	}
+
+	// Flags taking one of a few words
+	for _, o := range []struct {
+		flag, value string
+		choices     []string
+		expected    string
+	}{
+		{"--match-case", c.MatchCase, []string{"preserve", "fold"}, "expected preserve or fold"},
+		{"--sort-case", c.SortCase, []string{"preserve", "fold"}, "expected preserve or fold"},
+		{"--byte-cut", c.ByteCut, []string{"line", "exact"}, "expected line or exact"},
+		{"--tie-break", c.TieBreak, []string{"longest", "firstlisted", "lastlisted"}, "expected longest, firstlisted or lastlisted"},
+		{"--word-boundary-mode", c.WordBoundaryMode, []string{"ascii", "unicode", "segment"}, "expected ascii, unicode or segment"},
+		{"--rate-overflow", c.RateOverflow, []string{"drop", "buffer"}, "expected drop or buffer"},
+		{"--final-tie", c.FinalTie, []string{"input", "raw", "none"}, "expected input, raw or none"},
+		{"--capture-fallback", c.CaptureFallback, []string{"line", "drop"}, "expected line or drop"},
+		{"--unmatched-sort", c.UnmatchedSort, []string{"lexical", "numeric", "reverse", "arrival", "newest"}, "expected lexical, numeric, reverse, arrival or newest"},
+		{"--band-order", c.BandOrder, []string{"content", "input"}, "expected content or input"},
+		{"--exec-stderr", c.ExecStderr, []string{"merge", "separate", "drop"}, "expected merge, separate or drop"},
+		{"--memory-policy", c.MemoryPolicy, []string{"flush", "evict"}, "expected flush or evict"},
+		{"--fingerprint-sample", c.FingerprintSample, []string{"first", "last"}, "expected first or last"},
+		{"--group-order", c.GroupOrder, []string{"first-seen", "size", "lexical"}, "expected first-seen, size or lexical"},
+		{"--source-order", c.SourceOrder, []string{"interleaved", "stdin-first", "exec-first"}, "use interleaved, stdin-first or exec-first"},
+		{"--buffer-source", c.BufferSource, []string{"stdin", "exec", "all"}, "use stdin, exec or all"},
+	} {
+		if !slices.Contains(o.choices, o.value) {
+			return fmt.Errorf("Invalid %s '%s': %s", o.flag, o.value, o.expected)
+		}
+	}
+
+	if c.UnmatchedRatioLimit > 0 && c.UnmatchedRatioWindow < 1 {
+		return fmt.Errorf("Invalid --unmatched-ratio-window: must be at least 1")
+	}
+	if c.InputBuffer < 0 {
+		return fmt.Errorf("Invalid --input-buffer-size: must not be negative")
+	}
+	for _, kv := range c.ExecEnv {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			return fmt.Errorf("Invalid --exec-env '%s': expected KEY=VALUE", kv)
+		}
+	}
+	if c.ExecDir != "" {
+		if fi, err := os.Stat(expand(c.ExecDir)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("Invalid --exec-dir '%s': not a directory", c.ExecDir)
+		}
+	}
+	if c.Syslog && c.SyslogTag == "" {
+		return fmt.Errorf("Invalid --syslog-tag: must not be empty")
+	}
+	// Without --split-tee the band files get every line, syslog none
+	if c.Syslog && c.SplitDir != "" && !c.SplitTee {
+		return fmt.Errorf("--syslog conflicts with --split-dir (add --split-tee to get both)")
+	}
+	if c.Canonical && c.FinalTie != "input" && c.FinalTie != "raw" {
+		return fmt.Errorf("--canonical conflicts with --final-tie %s", c.FinalTie)
+	}
+	if c.ByMatchCount && c.Weights != "" {
+		return fmt.Errorf("--by-match-count conflicts with --weights")
+	}
+	if c.Join < 0 {
+		return fmt.Errorf("Invalid --join %d: expected a line count", c.Join)
+	}
+	if c.Truncate < 0 {
+		return fmt.Errorf("Invalid --truncate %d: must not be negative", c.Truncate)
+	}
+	if c.Sample < 0 {
+		return fmt.Errorf("Invalid --sample %d: must not be negative", c.Sample)
+	}
+	if c.FlushOnPriority < -1 {
+		return fmt.Errorf("Invalid --flush-on-priority %d: use a band, or -1 for off", c.FlushOnPriority)
+	}
+	if c.BandOrder == "input" && c.JSONSortField != "" {
+		return fmt.Errorf("--band-order input conflicts with --json-sort-field")
+	}
+	if c.FilterTimeout < 0 {
+		return fmt.Errorf("Invalid --filter-timeout %v: must not be negative", c.FilterTimeout)
+	}
+	if c.OutputRing != "" && c.RingSize < 1 {
+		return fmt.Errorf("Invalid --ring-size: must be at least 1")
+	}
+	return nil
+}
+
+// flagTerminated reports whether the flags in args end with "--" rather than
+// at the first non-flag argument; a "--" that is a flag's value doesn't count
+func flagTerminated(fs *flag.FlagSet, args []string) bool {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return true
+		}
+		if len(a) < 2 || a[0] != '-' {
+			return false
+		}
+		name := strings.TrimLeft(a, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		i++ // Skip the value
+	}
+	return false
+}
+
+// filterFile is what a filter file holds besides its comments
+type filterFile struct {
+	args   string         // Option line(s) at the top, joined
+	specs  []string       // Filters in file order
+	labels map[int]string // Comments above each filter, by specs index
+	guards map[int]string // [when ...] guards, by specs index
+	lines  map[int]int    // 1-based line of each filter in the file, by specs index
+}
+
+// parseFilterFile splits the lines of a filter file into its option line and
+// filters; with strict, [options] and [filters] headers mark them instead
+func parseFilterFile(filterFileLines []string, strict bool) (filterFile, error) {
+	ff := filterFile{labels: map[int]string{}, guards: map[int]string{}, lines: map[int]int{}}
+
+	// Filter out comments and extract args/filters
+	var processedLines []string
+	var lineNos []int              // File line of each processed line
+	comments := map[int][]string{} // Comments above each processed line
+
+	// Remove comments first
+	for n, line := range filterFileLines {
+		trim := strings.TrimSpace(line)
+		if strings.HasPrefix(trim, "#") {
+			comments[len(processedLines)] = append(comments[len(processedLines)], trim)
+			continue
+		}
+		processedLines = append(processedLines, line)
+		lineNos = append(lineNos, n+1)
+	}
+	if len(processedLines) == 0 {
+		return ff, nil
+	}
+
+	first := processedLines[0]
+	trimFirst := strings.TrimSpace(first)
+
+	// Check if first line is an argument line
+	// Condition: Starts with "-" OR starts with whitespace (blanks)
+	isArgLine := strings.HasPrefix(trimFirst, "-") || (len(first) > 0 && (first[0] == ' ' || first[0] == '\t'))
+
+	argLineEndIndex := -1
+	var argBuilder strings.Builder
+
+	if strict {
+		// --strict-file-args: [options] and [filters] headers instead
+		// of guessing
+		isArgLine = false
+		end, err := strictFileSections(processedLines, &argBuilder)
+		if err != nil {
+			return ff, err
+		}
+		argLineEndIndex = end
+	}
+
+	if isArgLine {
+		// Parse argument block (handle backslash extension)
+		for i, line := range processedLines {
+			trim := strings.TrimSpace(line)
+			hasBackslash := strings.HasSuffix(trim, "\\")
+
+			content := trim
+			if hasBackslash {
+				content = strings.TrimSuffix(content, "\\")
+			}
+
+			if argBuilder.Len() > 0 {
+				argBuilder.WriteString(" ")
+			}
+			argBuilder.WriteString(content)
+
+			if !hasBackslash {
+				argLineEndIndex = i
+				break
+			}
+		}
+	}
+	ff.args = argBuilder.String()
+
+	// The rest are filters, in [when ...] ... [end] blocks or not
+	var pending []string
+	guard := ""
+	for i := argLineEndIndex + 1; i < len(processedLines); i++ {
+		l := processedLines[i]
+		pending = append(pending, comments[i]...)
+		if t := strings.TrimSpace(l); t != "" {
+			if g, ok := strings.CutPrefix(t, "[when "); ok && strings.HasSuffix(g, "]") {
+				guard = strings.TrimSuffix(g, "]")
+				continue
+			}
+			if t == "[end]" {
+				guard = ""
+				continue
+			}
+			if len(pending) > 0 {
+				ff.labels[len(ff.specs)] = strings.Join(pending, "\n")
+			}
+			if guard != "" {
+				ff.guards[len(ff.specs)] = guard
+			}
+			ff.lines[len(ff.specs)] = lineNos[i]
+			pending = nil
+			ff.specs = append(ff.specs, t)
+		}
+	}
+	return ff, nil
+}
+
+// strictFileSections reads a --strict-file-args filter file: lines under an
+// optional [options] header are args (a trailing backslash is allowed but not
+// needed), filters start after the [filters] header. Returns the index of
+// that header.
+func strictFileSections(lines []string, args *strings.Builder) (int, error) {
+	inOptions := false
+	for i, line := range lines {
+		trim := strings.TrimSpace(line)
+		switch {
+		case trim == "[filters]":
+			return i, nil
+		case trim == "[options]":
+			inOptions = true
+		case trim == "":
+		case !inOptions:
+			return 0, fmt.Errorf("line '%s' is outside the [options] and [filters] sections", trim)
+		default:
+			if args.Len() > 0 {
+				args.WriteString(" ")
+			}
+			args.WriteString(strings.TrimSuffix(trim, "\\"))
+		}
+	}
+	return 0, fmt.Errorf("missing [filters] header")
+}
+
+func tokenize(input string) []string {
+	var args []string
+	var current strings.Builder
+	inQuote := false
+	quoteChar := rune(0)
+
+	for _, r := range input {
+		switch {
+		case inQuote:
+			if r == quoteChar {
+				inQuote = false
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			inQuote = true
+			quoteChar = r
+		case r == ' ' || r == '\t':
+			if !inQuote {
+				if current.Len() > 0 {
+					args = append(args, current.String())
+					current.Reset()
+				}
+			} else {
+				current.WriteRune(r)
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// compileFilter parses an optional mode prefix (re:, glob: or lit:) and
+// compiles the filter honoring -i and -w
+func compileFilter(spec string, cfg *Config) (filter, error) {
+	if strings.HasPrefix(spec, "pattern=") {
+		return compileKeyValueFilter(spec, cfg)
+	}
+	if rest, ok := strings.CutPrefix(spec, "expr:"); ok {
+		node, err := parseExpr(rest, cfg.IgnoreCase)
+		return filter{spec: spec, mode: "expr", text: rest, runes: cfg.Runes, expr: node}, err
+	}
+	if terms, ok := parseFieldTerms(spec, cfg); ok {
+		return compileFieldFilter(spec, terms, cfg)
+	}
+	if args, ok := parseNear(spec); ok {
+		return compileNearFilter(spec, args, cfg)
+	}
+	if rest, ok := strings.CutPrefix(spec, "pin:"); ok {
+		f, err := compileFilter(rest, cfg)
+		f.spec, f.pinned = spec, true
+		return f, err
+	}
+
+	f := filter{spec: spec, mode: "literal", text: spec}
+	for _, mode := range []string{"re", "glob", "lit"} {
+		if rest, ok := strings.CutPrefix(spec, mode+":"); ok {
+			f.mode, f.text = mode, rest
+			break
+		}
+	}
+	if f.mode == "lit" {
+		f.mode = "literal"
+	}
+
+	var pattern string
+	switch f.mode {
+	case "literal":
+		if cfg.IgnoreCase {
+			f.text = lowerCase(f.text)
+		}
+		f.size = textLen(f.text, cfg.Runes)
+		if !cfg.WordBoundary {
+			return f, nil
+		}
+		pattern = regexp.QuoteMeta(f.text)
+	case "glob":
+		pattern, f.size = globToRegexp(f.text, cfg.Runes)
+	case "re":
+		pattern = f.text
+		f.runes = cfg.Runes
+	}
+
+	// Go's \b only knows ASCII word characters; unicode mode checks the
+	// boundaries around each match instead
+	if cfg.WordBoundary && cfg.WordBoundaryMode != "ascii" {
+		f.unicodeWords = true
+		f.segmentWords = cfg.WordBoundaryMode == "segment"
+	} else if cfg.WordBoundary {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if cfg.IgnoreCase {
+		pattern = `(?i)` + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return f, err
+	}
+	f.re = re
+	return f, nil
+}
+
+// compileKeyValueFilter compiles a key=value filter line such as
+// `pattern="ERROR:" priority=0 word=true`, which spares colon-heavy
+// patterns from the field and prefix syntaxes: the pattern is taken as is,
+// in the mode given by mode= (literal by default)
+func compileKeyValueFilter(spec string, cfg *Config) (filter, error) {
+	local := *cfg
+	pattern, mode, band := "", "lit", -1
+	for _, tok := range tokenize(spec) {
+		key, value, ok := strings.Cut(tok, "=")
+		if !ok {
+			return filter{spec: spec}, fmt.Errorf("expected key=value, got '%s'", tok)
+		}
+		switch key {
+		case "pattern":
+			pattern = value
+		case "mode":
+			switch value {
+			case "literal", "lit":
+				mode = "lit"
+			case "re", "glob":
+				mode = value
+			default:
+				return filter{spec: spec}, fmt.Errorf("invalid mode '%s'", value)
+			}
+		case "priority":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n >= unmatchedPriority {
+				return filter{spec: spec}, fmt.Errorf("invalid priority '%s'", value)
+			}
+			band = n
+		case "word":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return filter{spec: spec}, fmt.Errorf("invalid word '%s'", value)
+			}
+			local.WordBoundary = b
+		default:
+			return filter{spec: spec}, fmt.Errorf("unknown key '%s'", key)
+		}
+	}
+	if pattern == "" {
+		return filter{spec: spec}, fmt.Errorf("empty pattern")
+	}
+	f, err := compileFilter(mode+":"+pattern, &local)
+	if band >= 0 {
+		f.fixedBand, f.band = true, band
+	}
+	return f, err
+}
+
+// match reports whether line matches and the length to rank it by: the
+// filter length for literals and globs (literal characters only), the
+// matched text for regexps
+func (f *filter) match(line string) (bool, int) {
+	if f.guard != nil && !f.guard.eval(line) {
+		return false, 0
+	}
+	switch f.mode {
+	case "fields":
+		return f.matchFields(line)
+	case "near":
+		a, b := f.closestPair(line)
+		if a == nil {
+			return false, 0
+		}
+		return true, textLen(line[a[0]:a[1]], f.runes) + textLen(line[b[0]:b[1]], f.runes)
+	case "expr":
+		if !f.expr.eval(line) {
+			return false, 0
+		}
+		size := 0
+		for _, sp := range f.spans(line) {
+			size += textLen(line[sp[0]:sp[1]], f.runes)
+		}
+		return true, size
+	}
+	if f.re == nil {
+		return strings.Contains(line, f.text), f.size
+	}
+	if f.mode != "re" && !f.unicodeWords {
+		return f.re.MatchString(line), f.size
+	}
+	var loc []int
+	if f.unicodeWords {
+		if spans := f.spans(line); len(spans) > 0 {
+			loc = spans[0]
+		}
+	} else {
+		loc = f.re.FindStringIndex(line)
+	}
+	if loc == nil {
+		return false, 0
+	}
+	if f.mode != "re" {
+		return true, f.size
+	}
+	return true, textLen(line[loc[0]:loc[1]], f.runes)
+}
+
+// spans returns the byte ranges matched in line; compound field filters have
+// none, near filters the closest pair, expr filters their calls that hold
+// outside a not
+func (f *filter) spans(line string) [][]int {
+	switch f.mode {
+	case "fields":
+		return nil
+	case "near":
+		a, b := f.closestPair(line)
+		if a == nil {
+			return nil
+		}
+		if b[0] < a[0] {
+			a, b = b, a
+		}
+		return [][]int{a, b}
+	case "expr":
+		return mergeSpans(f.expr.spans(line, nil))
+	}
+	if f.re != nil && f.unicodeWords {
+		var spans [][]int
+		for _, loc := range f.re.FindAllStringIndex(line, -1) {
+			if atWordBoundary(line, loc[0], f.segmentWords) && atWordBoundary(line, loc[1], f.segmentWords) {
+				spans = append(spans, loc)
+			}
+		}
+		return spans
+	}
+	if f.re != nil {
+		return f.re.FindAllStringIndex(line, -1)
+	}
+	var spans [][]int
+	if f.text == "" {
+		return nil
+	}
+	for off := 0; ; {
+		i := strings.Index(line[off:], f.text)
+		if i < 0 {
+			return spans
+		}
+		spans = append(spans, []int{off + i, off + i + len(f.text)})
+		off += i + len(f.text)
+	}
+}
+
+// fieldTerm is one "N:pattern" condition of a compound field filter
+type fieldTerm struct {
+	field   int    // 1-based
+	name    string // --header-fields name instead of a number, resolved later
+	pattern string
+}
+
+// parseFieldTerms recognises "1:ERROR && 3:db": at least two terms joined by
+// && where every term starts with a field number. With --header-fields a term
+// may name its field instead ("status:5.."), and a single term is enough.
+func parseFieldTerms(spec string, cfg *Config) ([]fieldTerm, bool) {
+	parts := strings.Split(spec, "&&")
+	if len(parts) < 2 && !cfg.HeaderFields {
+		return nil, false
+	}
+	terms := make([]fieldTerm, 0, len(parts))
+	named := false
+	for _, p := range parts {
+		num, pattern, ok := strings.Cut(strings.TrimSpace(p), ":")
+		if !ok || pattern == "" {
+			return nil, false
+		}
+		n, err := strconv.Atoi(num)
+		switch {
+		case err == nil && n >= 1:
+			terms = append(terms, fieldTerm{field: n, pattern: pattern})
+		case err != nil && cfg.HeaderFields && isFieldName(num):
+			terms = append(terms, fieldTerm{name: num, pattern: pattern})
+			named = true
+		default:
+			return nil, false
+		}
+	}
+	if len(terms) < 2 && !named {
+		return nil, false
+	}
+	return terms, true
+}
+
+// isFieldName accepts header names usable in a field term: no spaces, not a
+// mode prefix, so "re:x" stays a regexp filter
+func isFieldName(s string) bool {
+	switch s {
+	case "", "re", "glob", "lit", "pin", "expr":
+		return false
+	}
+	return !strings.ContainsFunc(s, unicode.IsSpace)
+}
+
+// headerColumns maps the --header-fields names to their 1-based positions;
+// the first of duplicate names wins
+func headerColumns(header, delim string) map[string]int {
+	columns := make(map[string]int)
+	for i, name := range splitFields(header, delim) {
+		name = strings.TrimSpace(name)
+		if _, dup := columns[name]; !dup && name != "" {
+			columns[name] = i + 1
+		}
+	}
+	return columns
+}
+
+// resolveFieldNames numbers the named field terms of filters from the header
+func resolveFieldNames(filters []filter, columns map[string]int) error {
+	for i := range filters {
+		f := &filters[i]
+		for j, name := range f.names {
+			if name == "" {
+				continue
+			}
+			n, ok := columns[name]
+			if !ok {
+				return fmt.Errorf("no field '%s' for filter '%s' in the header", name, f.spec)
+			}
+			f.fields[j] = n
+		}
+		if err := resolveFieldNames(f.subs, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileFieldFilter builds a filter matching only when every term matches
+// its field. Each term pattern is a regular filter, so mode prefixes work.
+func compileFieldFilter(spec string, terms []fieldTerm, cfg *Config) (filter, error) {
+	f := filter{spec: spec, mode: "fields", text: spec, delim: cfg.Delimiter}
+	for _, t := range terms {
+		sub, err := compileFilter(t.pattern, cfg)
+		if err != nil {
+			return f, err
+		}
+		f.fields = append(f.fields, t.field)
+		f.names = append(f.names, t.name)
+		f.subs = append(f.subs, sub)
+		f.size += sub.size
+	}
+	return f, nil
+}
+
+// pickFilter returns the index of the winning filter for line (-1 if none
+// matches) and the line's --score. The scan stops early when the rest can't
+// change the outcome.
+func pickFilter(filters []filter, line string, cfg *Config) (int, int) {
+	matchedIndex := -1
+	matchLen := 0
+	score := 0
+
+	// Without --score only the winner matters, so the first listed match or
+	// (with --priority-zero-wins) a match of filter 0 settles it
+	early := !cfg.Score
+
+	for i := range filters {
+		matched, l := filters[i].match(line)
+		if !matched {
+			continue
+		}
+		score += filters[i].weight
+		switch cfg.TieBreak {
+		case "firstlisted":
+			if early {
+				return i, score
+			}
+			if matchedIndex == -1 {
+				matchedIndex = i
+			}
+		case "lastlisted":
+			matchedIndex = i
+		default: // longest
+			if early && i == 0 && cfg.PriorityZeroWins {
+				return 0, score
+			}
+			if l > matchLen {
+				matchedIndex = i
+				matchLen = l
+			}
+		}
+	}
+	return matchedIndex, score
+}
+
+// parseNear splits "near(A,B,N)" into its terms and distance. A ends at the
+// first comma and N starts after the last, so B may contain commas.
+func parseNear(spec string) ([]string, bool) {
+	inner, ok := strings.CutPrefix(spec, "near(")
+	if !ok || !strings.HasSuffix(inner, ")") {
+		return nil, false
+	}
+	inner = strings.TrimSuffix(inner, ")")
+	first, last := strings.Index(inner, ","), strings.LastIndex(inner, ",")
+	if first < 0 || first == last {
+		return nil, false
+	}
+	return []string{
+		strings.TrimSpace(inner[:first]),
+		strings.TrimSpace(inner[first+1 : last]),
+		strings.TrimSpace(inner[last+1:]),
+	}, true
+}
+
+// compileNearFilter builds a filter matching when both terms occur within
+// distance characters of each other. Terms are regular filters.
+func compileNearFilter(spec string, args []string, cfg *Config) (filter, error) {
+	f := filter{spec: spec, mode: "near", text: spec, runes: cfg.Runes}
+	d, err := strconv.Atoi(args[2])
+	if err != nil || d < 0 {
+		return f, fmt.Errorf("invalid distance '%s'", args[2])
+	}
+	f.distance = d
+	for _, term := range args[:2] {
+		if term == "" {
+			return f, fmt.Errorf("empty term")
+		}
+		sub, err := compileFilter(term, cfg)
+		if err != nil {
+			return f, err
+		}
+		f.subs = append(f.subs, sub)
+	}
+	return f, nil
+}
+
+// closestPair returns the occurrences of the two near terms with the smallest
+// gap between them, or nil when no pair is within the distance
+func (f *filter) closestPair(line string) ([]int, []int) {
+	var bestA, bestB []int
+	best := -1
+	bs := f.subs[1].spans(line)
+	for _, a := range f.subs[0].spans(line) {
+		for _, b := range bs {
+			gap := 0
+			switch {
+			case a[1] <= b[0]:
+				gap = textLen(line[a[1]:b[0]], f.runes)
+			case b[1] <= a[0]:
+				gap = textLen(line[b[1]:a[0]], f.runes)
+			}
+			if best == -1 || gap < best {
+				bestA, bestB, best = a, b, gap
+			}
+		}
+	}
+	if best == -1 || best > f.distance {
+		return nil, nil
+	}
+	return bestA, bestB
+}
+
+// splitFilterList splits a comma separated filter list, keeping the commas
+// of near(...) filters and inside the strings of expr: filters
+func splitFilterList(list string) []string {
+	var out []string
+	parts := strings.Split(list, ",")
+	for i := 0; i < len(parts); i++ {
+		p := parts[i]
+		if strings.HasPrefix(strings.TrimSpace(p), "near(") {
+			for !strings.HasSuffix(strings.TrimSpace(p), ")") && i+1 < len(parts) {
+				i++
+				p += "," + parts[i]
+			}
+		}
+		if strings.HasPrefix(strings.TrimSpace(p), "expr:") {
+			for (strings.Count(p, `"`)-strings.Count(p, `\"`))%2 == 1 && i+1 < len(parts) {
+				i++
+				p += "," + parts[i]
+			}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// exprNode is a node of an expr: filter, a call such as contains("x") or
+// not, and, or over its subs
+type exprNode struct {
+	op   string // contains, startswith, endswith, not, and or or
+	arg  string
+	subs []*exprNode
+}
+
+func (n *exprNode) eval(line string) bool {
+	switch n.op {
+	case "contains":
+		return strings.Contains(line, n.arg)
+	case "startswith":
+		return strings.HasPrefix(line, n.arg)
+	case "endswith":
+		return strings.HasSuffix(line, n.arg)
+	case "not":
+		return !n.subs[0].eval(line)
+	case "and":
+		for _, sub := range n.subs {
+			if !sub.eval(line) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, sub := range n.subs {
+			if sub.eval(line) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spans appends the ranges of the calls holding in line to out; negated
+// calls have nothing to show
+func (n *exprNode) spans(line string, out [][]int) [][]int {
+	switch n.op {
+	case "contains":
+		if i := strings.Index(line, n.arg); i >= 0 {
+			out = append(out, []int{i, i + len(n.arg)})
+		}
+	case "startswith":
+		if strings.HasPrefix(line, n.arg) {
+			out = append(out, []int{0, len(n.arg)})
+		}
+	case "endswith":
+		if strings.HasSuffix(line, n.arg) {
+			out = append(out, []int{len(line) - len(n.arg), len(line)})
+		}
+	case "and", "or":
+		for _, sub := range n.subs {
+			out = sub.spans(line, out)
+		}
+	}
+	return out
+}
+
+// mergeSpans sorts spans and joins the overlapping ones
+func mergeSpans(spans [][]int) [][]int {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var out [][]int
+	for _, sp := range spans {
+		if last := len(out) - 1; last >= 0 && sp[0] <= out[last][1] {
+			out[last][1] = max(out[last][1], sp[1])
+			continue
+		}
+		out = append(out, []int{sp[0], sp[1]})
+	}
+	return out
+}
+
+// exprParser is a recursive-descent parser for expr: filters:
+//
+//	or    = and { "or" and }
+//	and   = unary { "and" unary }
+//	unary = "not" unary | "(" or ")" | call
+//	call  = ( "contains" | "startswith" | "endswith" ) "(" string ")"
+//
+// Strings are double quoted, with \" and \\ escapes.
+type exprParser struct {
+	src  string
+	pos  int
+	fold bool // -i: fold the strings like the lines they're matched against
+}
+
+// parseExpr parses an expr: filter, reporting errors with their column
+func parseExpr(src string, fold bool) (*exprNode, error) {
+	p := &exprParser{src: src, fold: fold}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return n, nil
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("column %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// word reads the identifier at the current position without consuming it
+func (p *exprParser) word() string {
+	p.skipSpace()
+	end := p.pos
+	for end < len(p.src) && (p.src[end] >= 'a' && p.src[end] <= 'z' || p.src[end] >= 'A' && p.src[end] <= 'Z') {
+		end++
+	}
+	return p.src[p.pos:end]
+}
+
+func (p *exprParser) expect(c byte) error {
+	if p.skipSpace(); p.pos >= len(p.src) || p.src[p.pos] != c {
+		return p.errorf("expected '%c'", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) or() (*exprNode, error) {
+	return p.binary("or", p.and)
+}
+
+func (p *exprParser) and() (*exprNode, error) {
+	return p.binary("and", p.unary)
+}
+
+// binary parses operands joined by the op keyword
+func (p *exprParser) binary(op string, operand func() (*exprNode, error)) (*exprNode, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	n := &exprNode{op: op, subs: []*exprNode{first}}
+	for p.word() == op {
+		p.pos += len(op)
+		sub, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		n.subs = append(n.subs, sub)
+	}
+	if len(n.subs) == 1 {
+		return first, nil
+	}
+	return n, nil
+}
+
+func (p *exprParser) unary() (*exprNode, error) {
+	switch w := p.word(); w {
+	case "not":
+		p.pos += len(w)
+		sub, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: "not", subs: []*exprNode{sub}}, nil
+	case "contains", "startswith", "endswith":
+		p.pos += len(w)
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		arg, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		if p.fold {
+			arg = lowerCase(arg)
+		}
+		return &exprNode{op: w, arg: arg}, nil
+	case "":
+		if p.pos < len(p.src) && p.src[p.pos] == '(' {
+			p.pos++
+			n, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(')')
+		}
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unexpected end of expression")
+		}
+		return nil, p.errorf("unexpected '%c'", p.src[p.pos])
+	default:
+		return nil, p.errorf("unknown function '%s'", w)
+	}
+}
+
+// str reads a double quoted string
+func (p *exprParser) str() (string, error) {
+	if p.skipSpace(); p.pos >= len(p.src) || p.src[p.pos] != '"' {
+		return "", p.errorf("expected a string")
+	}
+	start := p.pos
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		switch c := p.src[p.pos]; c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\\':
+			if p.pos+1 < len(p.src) && (p.src[p.pos+1] == '"' || p.src[p.pos+1] == '\\') {
+				p.pos++
+				b.WriteByte(p.src[p.pos])
+				continue
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+func (f *filter) matchFields(line string) (bool, int) {
+	fields := splitFields(line, f.delim)
+	size := 0
+	for i, n := range f.fields {
+		if n > len(fields) {
+			return false, 0
+		}
+		ok, l := f.subs[i].match(fields[n-1])
+		if !ok {
+			return false, 0
+		}
+		size += l
+	}
+	return true, size
+}
+
+// alignItems lines up the fields of the items' raw lines in columns. With a
+// delimiter it is kept at the end of each field.
+func alignItems(items []item, delim string) {
+	var out bytes.Buffer
+	tw := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	for _, it := range items {
+		fields := splitFields(it.raw, delim)
+		if delim != "" {
+			for i := range len(fields) - 1 {
+				fields[i] += delim
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(fields, "\t"))
+	}
+	tw.Flush()
+	for i, line := range strings.SplitN(strings.TrimSuffix(out.String(), "\n"), "\n", len(items)) {
+		items[i].raw = strings.TrimRight(line, " ")
+	}
+}
+
+// atWordBoundary reports whether i sits between a word and a non-word rune
+// (or the line's edge), with letters, digits, marks and _ as word runes.
+// With segment, Han and Hiragana characters are words of their own as in
+// Unicode word segmentation (UAX #29), while marks stay with the character
+// they follow.
+func atWordBoundary(line string, i int, segment bool) bool {
+	before, _ := utf8.DecodeLastRuneInString(line[:i])
+	after, _ := utf8.DecodeRuneInString(line[i:])
+	if isWordRune(before, i > 0) != isWordRune(after, i < len(line)) {
+		return true
+	}
+	return segment && i > 0 && i < len(line) && !unicode.IsMark(after) &&
+		(unicode.In(before, unicode.Han, unicode.Hiragana) || unicode.In(after, unicode.Han, unicode.Hiragana))
+}
+
+func isWordRune(r rune, ok bool) bool {
+	return ok && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r))
+}
+
+// textLen is the length every length-based feature ranks by: bytes, or
+// runes with --runes
+func textLen(s string, runes bool) int {
+	if runes {
+		return utf8.RuneCountInString(s)
+	}
+	return len(s)
+}
+
+// splitFields splits on delim, or on runs of whitespace when delim is empty
+func splitFields(line, delim string) []string {
+	if delim == "" {
+		return strings.Fields(line)
+	}
+	return strings.Split(line, delim)
+}
+
+// globToRegexp translates * ? and [...] into an unanchored regexp and
+// measures the literal characters
+func globToRegexp(glob string, runes bool) (string, int) {
+	var b strings.Builder
+	literals := 0
+	inClass := false
+	for _, r := range glob {
+		switch {
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+			b.WriteRune(r)
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		case r == '[':
+			inClass = true
+			b.WriteRune(r)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			literals += textLen(string(r), runes)
+		}
+	}
+	return b.String(), literals
+}
+
+// render turns an item into its output line
+func render(it item, cfg *Config) string {
+	line := it.raw
+	if !it.marker {
+		line = trimMatch(line, trimPrefix, cfg.Color)
+		line = trimMatch(line, trimSuffix, cfg.Color)
+	}
+	recolor := cfg.Recolor != "" && !it.marker
+	if recolor && cfg.Color {
+		line = ansiRegex.ReplaceAllString(line, "")
+	}
+	if cfg.ContextChars > 0 && it.match != nil && !it.marker {
+		line = matchWindow(line, it.match, cfg.ContextChars, cfg)
+	}
+	if cfg.HighlightAll && it.all != nil {
+		line = highlightAll(line, it.all, cfg)
+	} else if cfg.Highlight && it.match != nil {
+		line = highlight(line, it.match, cfg)
+	}
+	if cfg.Hyperlinks && it.match != nil {
+		line = hyperlink(line, cfg)
+	}
+	if recolor {
+		// Highlights end in a reset, after which the color starts again
+		code := "\x1b[" + cfg.Recolor + "m"
+		line = code + strings.ReplaceAll(line, highlightOff, highlightOff+code) + highlightOff
+	}
+	if it.kept {
+		line = cfg.KeepLabel + line
+	}
+	if it.report != "" && !it.marker {
+		line += " " + it.report
+	}
+	if cfg.DryMatch && !it.marker {
+		line += " " + dryMatchNote(it)
+	}
+	if cfg.ShowKey && !it.marker {
+		// The key is what flush compares: band first, then the clean line
+		line = fmt.Sprintf("%d:%s\t%s", it.priority, it.clean, line)
+	}
+	if cfg.ByteOffsets && !it.marker {
+		line = fmt.Sprintf("%d:%s", it.offset, line)
+	}
+	if outputFormat != nil && !it.marker {
+		line = formatLine(it, line)
+	}
+	return line
+}
+
+// truncateLines applies truncateLine to each physical line of a
+// --flatten=false record on its own
+func truncateLines(line string, n int) string {
+	parts := strings.Split(line, "\n")
+	for i := range parts {
+		parts[i] = truncateLine(parts[i], n)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// truncateLine cuts line to n visible characters, the last one an ellipsis.
+// Escape sequences don't count and are all kept, also past the cut, so
+// colors get reset and hyperlinks closed as in the full line.
+func truncateLine(line string, n int) string {
+	visible := 0
+	for i := 0; i < len(line); {
+		if l := escapeLen(line[i:]); l > 0 {
+			i += l
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		visible++
+		i += size
+	}
+	if visible <= n {
+		return line
+	}
+
+	var b strings.Builder
+	visible = 0
+	for i := 0; i < len(line); {
+		if l := escapeLen(line[i:]); l > 0 {
+			b.WriteString(line[i : i+l])
+			i += l
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		switch {
+		case visible < n-1:
+			b.WriteString(line[i : i+size])
+		case visible == n-1:
+			b.WriteString("…")
+		}
+		visible++
+		i += size
+	}
+	return b.String()
+}
+
+// escapeLen is the length of the terminal escape sequence s starts with: CSI
+// (colors) up to its final byte, OSC (hyperlinks) up to BEL or ST; 0 if none
+func escapeLen(s string) int {
+	if len(s) < 2 || s[0] != '\x1b' {
+		return 0
+	}
+	switch s[1] {
+	case '[':
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return len(s)
+	case ']':
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(s)
+	}
+	return 2
+}
+
+// dryMatchNote is the --dry-match classification of it
+func dryMatchNote(it item) string {
+	if it.match == nil {
+		return "[unmatched]"
+	}
+	return fmt.Sprintf("[priority=%d filter=%s]", it.priority, it.match.described())
+}
+
+// matchReport lists the filters matching line as {spec,spec}
+func matchReport(filters []filter, line string) string {
+	var specs []string
+	for i := range filters {
+		if ok, _ := filters[i].match(line); ok {
+			specs = append(specs, filters[i].described())
+		}
+	}
+	return "{" + strings.Join(specs, ",") + "}"
+}
+
+// described is the filter as written, followed by [file:line] when it was
+// read from a filter file
+func (f *filter) described() string {
+	if f.source == "" {
+		return f.spec
+	}
+	return f.spec + " [" + f.source + "]"
+}
+
+// formatFields are the fields a --format template sees
+type formatFields struct {
+	Line     string // The line as it would be printed without --format
+	Raw      string // The input line as read
+	Priority int    // Band, 999999 when unmatched
+	Filter   string // Winning filter as written, empty when unmatched
+	Matched  bool
+	LineNo   int   // Input line number
+	Offset   int64 // Byte offset of the line, with --byte-offsets
+}
+
+// formatWarned makes a failing --format template warn only once
+var formatWarned sync.Once
+
+// formatLine runs the --format template for it; when that fails, line is
+// printed as it is
+func formatLine(it item, line string) string {
+	fields := formatFields{Line: line, Raw: it.raw, Priority: it.priority, Matched: it.match != nil, LineNo: it.lineNo, Offset: it.offset}
+	if it.match != nil {
+		fields.Filter = it.match.spec
+	}
+	var b strings.Builder
+	if err := outputFormat.Execute(&b, fields); err != nil {
+		formatWarned.Do(func() { warnf("Error running --format template: %v\n", err) })
+		return line
+	}
+	return b.String()
+}
+
+// plainText is a line with its ANSI codes removed (only with --color),
+// remembering where each plain byte sits in the raw line
+type plainText struct {
+	raw   string
+	plain string
+	pos   []int // pos[i] is the index in raw of plain[i]; nil if nothing was stripped
+}
+
+func newPlainText(raw string, color bool) plainText {
+	p := plainText{raw: raw, plain: raw}
+	if !color {
+		return p
+	}
+	var b strings.Builder
+	last := 0
+	for _, loc := range ansiRegex.FindAllStringIndex(raw, -1) {
+		for i := last; i < loc[0]; i++ {
+			p.pos = append(p.pos, i)
+		}
+		b.WriteString(raw[last:loc[0]])
+		last = loc[1]
+	}
+	for i := last; i < len(raw); i++ {
+		p.pos = append(p.pos, i)
+	}
+	b.WriteString(raw[last:])
+	p.plain = b.String()
+	return p
+}
+
+// rawSpan maps a non-empty plain span to raw, start and end inclusive of any
+// codes inside it
+func (p plainText) rawSpan(start, end int) (int, int) {
+	if p.pos == nil {
+		return start, end
+	}
+	return p.pos[start], p.pos[end-1] + 1
+}
+
+// captureGroup returns group n of f's match in raw, found on the plain text
+// and cut from raw. Only regexp filters have groups.
+func captureGroup(raw string, f *filter, n int, color bool) (string, bool) {
+	if f == nil || f.mode != "re" {
+		return "", false
+	}
+	text := newPlainText(raw, color)
+	m := f.re.FindStringSubmatchIndex(text.plain)
+	if m == nil || 2*n+1 >= len(m) || m[2*n] < 0 {
+		return "", false
+	}
+	if m[2*n] == m[2*n+1] {
+		return "", true
+	}
+	start, end := text.rawSpan(m[2*n], m[2*n+1])
+	return raw[start:end], true
+}
+
+// trimMatch cuts what re matches in the line's plain text (--trim-prefix and
+// --trim-suffix). Escape codes inside the cut part are kept.
+func trimMatch(raw string, re *regexp.Regexp, color bool) string {
+	if re == nil {
+		return raw
+	}
+	text := newPlainText(raw, color)
+	loc := re.FindStringIndex(text.plain)
+	if loc == nil || loc[0] == loc[1] {
+		return raw
+	}
+	start, end := text.rawSpan(loc[0], loc[1])
+	codes := strings.Join(ansiRegex.FindAllString(raw[start:end], -1), "")
+	return raw[:start] + codes + raw[end:]
+}
+
+// matchWindow cuts raw down to the filter's first match and n characters on
+// each side (--context-chars), with an ellipsis where something was cut.
+// With --color, the codes from the cut parts are kept.
+func matchWindow(raw string, f *filter, n int, cfg *Config) string {
+	text := newPlainText(raw, cfg.Color)
+	search := text.plain
+	if cfg.IgnoreCase {
+		search = lowerCase(text.plain)
+		if len(search) != len(text.plain) {
+			return raw // Case folding moved offsets, don't guess
+		}
+	}
+	spans := f.spans(search)
+	if len(spans) == 0 {
+		return raw
+	}
+	start, end := spans[0][0], spans[0][1]
+	for i := 0; i < n && start > 0; i++ {
+		_, size := utf8.DecodeLastRuneInString(text.plain[:start])
+		start -= size
+	}
+	for i := 0; i < n && end < len(text.plain); i++ {
+		_, size := utf8.DecodeRuneInString(text.plain[end:])
+		end += size
+	}
+	if start == 0 && end == len(text.plain) || start == end {
+		return raw
+	}
+
+	rawStart, rawEnd := text.rawSpan(start, end)
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+		if cfg.Color {
+			b.WriteString(strings.Join(ansiRegex.FindAllString(raw[:rawStart], -1), ""))
+		}
+	}
+	b.WriteString(raw[rawStart:rawEnd])
+	if end < len(text.plain) {
+		if cfg.Color {
+			b.WriteString(strings.Join(ansiRegex.FindAllString(raw[rawEnd:], -1), ""))
+		}
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// highlight wraps the filter's matches in raw with highlight codes. With
+// --color, matches are found on the stripped text and mapped back around the
+// existing escape codes, which are re-applied after each highlight.
+func highlight(raw string, f *filter, cfg *Config) string {
+	text := newPlainText(raw, cfg.Color)
+	search := text.plain
+	if cfg.IgnoreCase {
+		search = lowerCase(text.plain)
+		if len(search) != len(text.plain) {
+			return raw // Case folding moved offsets, don't guess
+		}
+	}
+
+	spans := f.spans(search)
+	if len(spans) == 0 {
+		return raw
+	}
+	return paintSpans(raw, text, spans, nil)
+}
+
+// highlightAllColors are the --highlight-all colors, by filter position
+var highlightAllColors = []string{"\x1b[1;31m", "\x1b[1;33m", "\x1b[1;32m", "\x1b[1;36m", "\x1b[1;35m", "\x1b[1;34m"}
+
+// highlightAll colors the matches of every filter matching raw, each filter
+// in its own color. Where matches overlap the earlier filter keeps the text.
+func highlightAll(raw string, filters []filter, cfg *Config) string {
+	text := newPlainText(raw, cfg.Color)
+	search := text.plain
+	if cfg.IgnoreCase {
+		search = lowerCase(text.plain)
+		if len(search) != len(text.plain) {
+			return raw // Case folding moved offsets, don't guess
+		}
+	}
+
+	owner := make([]int, len(search)) // Filter coloring each byte, -1 for none
+	for i := range owner {
+		owner[i] = -1
+	}
+	for i := range filters {
+		if ok, _ := filters[i].match(search); !ok {
+			continue
+		}
+		for _, sp := range filters[i].spans(search) {
+			for k := sp[0]; k < sp[1]; k++ {
+				if owner[k] == -1 {
+					owner[k] = i
+				}
+			}
+		}
+	}
+
+	// Runs of bytes with the same filter become the spans to paint
+	var spans [][]int
+	var codes []string
+	for k := 0; k < len(owner); {
+		end := k + 1
+		for end < len(owner) && owner[end] == owner[k] {
+			end++
+		}
+		if owner[k] != -1 {
+			spans = append(spans, []int{k, end})
+			codes = append(codes, highlightAllColors[owner[k]%len(highlightAllColors)])
+		}
+		k = end
+	}
+	if len(spans) == 0 {
+		return raw
+	}
+	return paintSpans(raw, text, spans, codes)
+}
+
+// paintSpans wraps the plain text spans, sorted and not overlapping, in
+// codes[i] (highlightOn when codes is nil) and a reset, mapped back to raw
+func paintSpans(raw string, text plainText, spans [][]int, codes []string) string {
+	var b strings.Builder
+	last := 0
+	for i, sp := range spans {
+		if sp[0] == sp[1] {
+			continue
+		}
+		code := highlightOn
+		if codes != nil {
+			code = codes[i]
+		}
+		start, end := text.rawSpan(sp[0], sp[1])
+		b.WriteString(raw[last:start])
+		b.WriteString(code)
+		b.WriteString(ansiRegex.ReplaceAllString(raw[start:end], ""))
+		b.WriteString(highlightOff)
+		// Restore whatever colors were active in the original line
+		for _, code := range ansiRegex.FindAllString(raw[:end], -1) {
+			b.WriteString(code)
+		}
+		last = end
+	}
+	b.WriteString(raw[last:])
+	return b.String()
+}
+
+// fileRefRegex finds path:line and path:line:col references. The path needs
+// a file extension to keep ratios and timestamps out.
+var fileRefRegex = regexp.MustCompile(`(?:^|[\s('"])((?:[\w.~-]*/)*[\w.-]*\w\.[A-Za-z][A-Za-z0-9]*):\d+(?::\d+)?`)
+
+// hyperlink turns file references into OSC 8 terminal hyperlinks pointing at
+// the absolute file path
+func hyperlink(raw string, cfg *Config) string {
+	text := newPlainText(raw, cfg.Color)
+	refs := fileRefRegex.FindAllStringSubmatchIndex(text.plain, -1)
+	if len(refs) == 0 {
+		return raw
+	}
+	host, _ := os.Hostname()
+
+	var b strings.Builder
+	last := 0
+	for _, ref := range refs {
+		// ref[2]:ref[3] is the path, ref[3]:ref[1] the :line(:col) suffix
+		start, end := text.rawSpan(ref[2], ref[1])
+		path := expand(text.plain[ref[2]:ref[3]])
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		u := url.URL{Scheme: "file", Host: host, Path: path}
+		b.WriteString(raw[last:start])
+		b.WriteString("\x1b]8;;" + u.String() + "\x1b\\")
+		b.WriteString(raw[start:end])
+		b.WriteString("\x1b]8;;\x1b\\")
+		last = end
+	}
+	b.WriteString(raw[last:])
+	return b.String()
+}
+
+func printVersionJSON() {
+	info := struct {
+		Version string `json:"version"`
+		Go      string `json:"go"`
+		Commit  string `json:"commit"`
+	}{Version: VERSION, Go: runtime.Version(), Commit: commit}
+
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Commit == "" {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info.Commit = s.Value
+			}
+		}
+	}
+	out, _ := json.Marshal(info)
+	fmt.Println(string(out))
+}
+
+// printColorTest renders sample lines through the output path with the
+// escape sequences ssort can emit, to check a terminal before relying on them
+func printColorTest(w io.Writer) {
+	samples := []struct {
+		label, line string
+		cfg         Config
+	}{
+		{"--highlight", "db: ERROR connection refused", Config{Highlight: true}},
+		{"--highlight --color", "\x1b[32m12:00:01\x1b[0m ERROR \x1b[2mretrying\x1b[0m", Config{Highlight: true, Color: true}},
+		{"--recolor 33", "db: ERROR connection refused", Config{Highlight: true, Recolor: "33"}},
+		{"--recolor 2 (dim)", "db: ERROR connection refused", Config{Highlight: true, Recolor: "2"}},
+		{"--hyperlinks", "ERROR at main.go:42", Config{Hyperlinks: true}},
+	}
+	for _, s := range samples {
+		f, _ := compileFilter("ERROR", &s.cfg)
+		fmt.Fprintf(w, "%-22s %s\n", s.label, render(item{raw: s.line, match: &f}, &s.cfg))
+	}
+	fmt.Fprintf(w, "%-22s %s plain line\n", "--prefix-color 36", "\x1b[36m[app]"+highlightOff)
+}
+
+// syslogWriter is the part of *syslog.Writer ssort uses
+type syslogWriter interface {
+	Err(m string) error
+	Warning(m string) error
+	Info(m string) error
+	Close() error
+}
+
+// logItem sends a line at the severity of its band: the top band is an
+// error, other matches are warnings, everything else is informational
+func logItem(w syslogWriter, it item, line string) error {
+	switch {
+	case it.marker || it.priority == unmatchedPriority:
+		return w.Info(line)
+	case it.priority == 0:
+		return w.Err(line)
+	default:
+		return w.Warning(line)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// exit ends the program with code, or 0 with --always-exit-zero
+func exit(code int) {
+	if alwaysExitZero {
+		code = 0
+	}
+	removePidFile()
+	os.Exit(code)
+}
+
+// removePidFile deletes the --pid-file, if one was written
+func removePidFile() {
+	if pidFile != "" {
+		os.Remove(pidFile)
+	}
+}
+
+// scanRawLines is bufio.ScanLines without dropping a trailing \r
+func scanRawLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// lowerCase lowercases s for -i. strings.ToLower turns invalid UTF-8 into
+// U+FFFD; with --binary-safe such bytes are copied unchanged instead.
+func lowerCase(s string) string {
+	if !binarySafe || utf8.ValidString(s) {
+		return strings.ToLower(s)
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b.WriteByte(s[i])
+		} else {
+			b.WriteRune(unicode.ToLower(r))
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// warnf reports a non-fatal problem on stderr unless --quiet-errors is set
+func warnf(format string, a ...any) {
+	if quietErrors {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format, a...)
+}
+
+// printStats writes an aligned table of per-filter match counts, most
+// frequent first. Percentages are relative to all input lines.
+func printStats(w io.Writer, filters []filter, counts []int, unmatched, total int) {
+	type row struct {
+		name     string
+		priority int // The filter's band, unmatchedPriority for unmatched
+		count    int
+	}
+	rows := make([]row, 0, len(filters)+1)
+	for i, f := range filters {
+		band := i
+		if f.fixedBand {
+			band = f.band
+		}
+		rows = append(rows, row{f.spec, band, counts[i]})
+	}
+	rows = append(rows, row{"(unmatched)", unmatchedPriority, unmatched})
+	// Most matches first, equal counts in band order
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].count != rows[j].count {
+			return rows[i].count > rows[j].count
+		}
+		return rows[i].priority < rows[j].priority
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILTER\tPRIORITY\tMATCHES\tPERCENT")
+	for _, r := range rows {
+		pct := 0.0
+		if total > 0 {
+			pct = float64(r.count) * 100 / float64(total)
+		}
+		priority := "-"
+		if r.priority != unmatchedPriority {
+			priority = strconv.Itoa(r.priority)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.1f%%\n", r.name, priority, r.count, pct)
+	}
+	tw.Flush()
+}
+
+// decompressors recognise compressed input by its leading bytes. New formats
+// only need an entry here.
+var decompressors = []struct {
+	match func(head []byte) bool
+	open  func(r io.Reader) (io.Reader, error)
+}{
+	{
+		match: func(head []byte) bool { return bytes.HasPrefix(head, []byte{0x1f, 0x8b}) },
+		open:  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	},
+	{
+		// "BZh", block size digit, then the block magic (BCD pi)
+		match: func(head []byte) bool {
+			return len(head) >= 10 && bytes.HasPrefix(head, []byte("BZh")) &&
+				head[3] >= '1' && head[3] <= '9' &&
+				bytes.Equal(head[4:10], []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59})
+		},
+		open: func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil },
+	},
+	{
+		match: func(head []byte) bool { return bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}) },
+		open: func(r io.Reader) (io.Reader, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+}
+
+// decompress wraps r in a decompressor if it starts with a known magic,
+// otherwise returns it unchanged (buffered)
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	// Only look at what the first read returned; waiting for more would stall
+	// interactive input with short lines
+	br.Peek(1)
+	head, _ := br.Peek(min(br.Buffered(), 10))
+	for _, d := range decompressors {
+		if d.match(head) {
+			return d.open(br)
+		}
+	}
+	return br, nil
+}
+
+// lookupEncoding finds a charset by its IANA name or alias, or else by a
+// WHATWG label such as sjis
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		if enc, err = htmlindex.Get(name); err != nil {
+			return nil, fmt.Errorf("unknown charset")
+		}
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("charset not supported")
+	}
+	return enc, nil
+}
+
+// compileFilters compiles specs along with their --echo-comments labels,
+// pattern@priority bands and [when ...] guards, all keyed by specs index
+func compileFilters(specs []string, labels map[int]string, bands map[int]int, guards, sources map[int]string, cfg *Config) ([]filter, error) {
+	var filters []filter
+	for i, spec := range specs {
+		f, err := compileFilter(spec, cfg)
+		if err != nil {
+			if cfg.IgnoreFilterErrors {
+				// Skipped filters leave no gap: later ones move up a priority
+				warnf("Skipping invalid filter pattern '%s': %v\n", spec, err)
+				continue
+			}
+			return nil, fmt.Errorf("Invalid filter pattern '%s': %v", spec, err)
+		}
+		f.label = labels[i]
+		f.source = sources[i]
+		if band, ok := bands[i]; ok {
+			f.fixedBand, f.band = true, band
+		}
+		if g, ok := guards[i]; ok {
+			f.guard, err = parseExpr(g, cfg.IgnoreCase)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid guard '[when %s]': %v", g, err)
+			}
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// weighFilters sets the --score weights, explicit --weights in filter order
+// or else the first filter weighing the most, and returns the best score
+func weighFilters(filters []filter, cfg *Config) (int, error) {
+	maxScore := 0
+	weights := strings.Split(cfg.Weights, ",")
+	for i := range filters {
+		filters[i].weight = len(filters) - i
+		if cfg.ByMatchCount {
+			filters[i].weight = 1
+		}
+		if i < len(weights) && strings.TrimSpace(weights[i]) != "" {
+			w, err := strconv.Atoi(strings.TrimSpace(weights[i]))
+			if err != nil || w < 1 {
+				return 0, fmt.Errorf("Invalid weight '%s': expected a positive integer", weights[i])
+			}
+			filters[i].weight = w
+		}
+		maxScore += filters[i].weight
+	}
+	return maxScore, nil
+}
+
+// readControl passes the filter lists of "@filters LIST" lines read from r
+// to ch; other lines are warned about. It returns at EOF.
+func readControl(r io.ReadCloser, ch chan<- []string) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		if cmd != "@filters" {
+			warnf("Unknown control line '%s'\n", line)
+			continue
+		}
+		var specs []string
+		for _, p := range splitFilterList(arg) {
+			if p = strings.TrimSpace(p); p != "" {
+				specs = append(specs, p)
+			}
+		}
+		ch <- specs
+	}
+}
+
+// compileFilterList compiles filters swapped in over --control-fd. Weights
+// are the defaults, as --weights belongs to the original list.
+func compileFilterList(specs []string, cfg *Config) ([]filter, error) {
+	filters := make([]filter, 0, len(specs))
+	for i, spec := range specs {
+		f, err := compileFilter(spec, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pattern '%s': %v", spec, err)
+		}
+		f.weight = len(specs) - i
+		if cfg.ByMatchCount {
+			f.weight = 1
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// listFlag collects the values of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// bandShift is a --demote (positive delta) or --promote pattern
+type bandShift struct {
+	f     filter
+	delta int
+}
+
+// shiftBand applies every shift matching line to priority, staying between
+// the top band and last
+func shiftBand(priority int, shifts []bandShift, line string, last int) int {
+	for i := range shifts {
+		if ok, _ := shifts[i].f.match(line); ok {
+			priority += shifts[i].delta
+		}
+	}
+	return min(max(priority, 0), last)
+}
+
+// lastBand is the lowest band a matched line can get from filters: the
+// last filter or fixed band, or with --score the one of the lightest filter
+func lastBand(filters []filter, cfg *Config, maxScore int) int {
+	last := 0
+	for i := range filters {
+		switch {
+		case cfg.Score:
+			last = max(last, maxScore-filters[i].weight)
+		case filters[i].fixedBand:
+			last = max(last, filters[i].band)
+		default:
+			last = max(last, i)
+		}
+	}
+	return last
+}
+
+// byteSize is a flag value in bytes, with an optional K, M or G suffix
+// (powers of 1024)
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	mult, digits := int64(1), value
+	switch {
+	case strings.HasSuffix(value, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		digits = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+func matchesAny(filters []filter, s string) bool {
+	for i := range filters {
+		if ok, _ := filters[i].match(s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseRunes reverses s by code point, so multibyte characters stay intact
+func reverseRunes(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// adaptiveTimeout shrinks the base timeout as the buffer grows: every 100
+// buffered lines divide it further, down to a tenth of the base.
+func adaptiveTimeout(base time.Duration, buffered int) time.Duration {
+	d := base / time.Duration(1+buffered/100)
+	if floor := base / 10; d < floor {
+		return floor
+	}
+	return d
+}
+
+// rateTracker remembers recent match times for one filter. At most
+// threshold+1 timestamps are kept, which is all hit needs.
+type rateTracker struct {
+	times []time.Time
+}
+
+// hit records a match at now and reports whether more than threshold matches
+// happened within the window
+func (r *rateTracker) hit(now time.Time, window time.Duration, threshold int) bool {
+	r.times = append(r.times, now)
+	cutoff := now.Add(-window)
+	drop := 0
+	for drop < len(r.times) && r.times[drop].Before(cutoff) {
+		drop++
+	}
+	if excess := len(r.times) - drop - (threshold + 1); excess > 0 {
+		drop += excess
+	}
+	r.times = append(r.times[:0], r.times[drop:]...)
+	return len(r.times) > threshold
+}
+
+var leadingNumberRegex = regexp.MustCompile(`^\s*[-+]?(\d+\.?\d*|\.\d+)`)
+
+// unmatchedLess orders two unmatched lines by --unmatched-sort. arrival and
+// newest keep input order here; flush reverses it for newest.
+func unmatchedLess(a, b, mode string) bool {
+	switch mode {
+	case "numeric":
+		// Lines starting with a number come first, smallest first
+		na, errA := strconv.ParseFloat(strings.TrimSpace(leadingNumberRegex.FindString(a)), 64)
+		nb, errB := strconv.ParseFloat(strings.TrimSpace(leadingNumberRegex.FindString(b)), 64)
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			return na < nb
+		case (errA == nil) != (errB == nil):
+			return errA == nil
+		}
+		return a < b
+	case "reverse":
+		return a > b
+	case "arrival", "newest":
+		return false
+	}
+	return a < b
+}
+
+// dedupWindow remembers when each key was last let through
+type dedupWindow struct {
+	window    time.Duration
+	last      map[string]time.Time
+	nextPrune int
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{window: window, last: map[string]time.Time{}, nextPrune: 1024}
+}
+
+// seen reports whether key was let through less than the window ago. Keys
+// that are let through start a new window.
+func (d *dedupWindow) seen(key string, now time.Time) bool {
+	if t, ok := d.last[key]; ok && now.Sub(t) < d.window {
+		return true
+	}
+	d.last[key] = now
+	if len(d.last) >= d.nextPrune {
+		for k, t := range d.last {
+			if now.Sub(t) >= d.window {
+				delete(d.last, k)
+			}
+		}
+		d.nextPrune = max(1024, 2*len(d.last))
+	}
+	return false
+}
+
+// lineKey is the first capture group of re in line, or the whole match
+// without groups, or the whole line without re. Lines re doesn't match have
+// no key.
+func lineKey(line string, re *regexp.Regexp) (string, bool) {
+	if re == nil {
+		return line, true
+	}
+	m := re.FindStringSubmatch(line)
+	switch {
+	case m == nil:
+		return "", false
+	case len(m) > 1:
+		return m[1], true
+	default:
+		return m[0], true
+	}
+}
+
+// joinLines turns the lines from in into records of n lines (--join), or
+// starting at each line delim matches (--join-delimiter), joined with sep.
+// A partial record goes out at the end of each run.
+func joinLines(in <-chan inputLine, n int, delim *regexp.Regexp, color bool, sep string) <-chan inputLine {
+	out := make(chan inputLine, cap(in))
+	go func() {
+		defer close(out)
+		var record []string
+		var first inputLine // The record takes its offset and source
+		send := func() {
+			if len(record) > 0 {
+				first.text = strings.Join(record, sep)
+				out <- first
+				record = record[:0]
+			}
+		}
+		for l := range in {
+			if l.event != 0 {
+				send()
+				out <- l
+				continue
+			}
+			if delim != nil && len(record) > 0 {
+				text := l.text
+				if color {
+					text = ansiRegex.ReplaceAllString(text, "")
+				}
+				if delim.MatchString(text) {
+					send()
+				}
+			}
+			if len(record) == 0 {
+				first = l
+			}
+			record = append(record, l.text)
+			if len(record) == n {
+				send()
+			}
+		}
+		send()
+	}()
+	return out
+}
+
+// reverseLines holds each run of input from in and passes it on last line
+// first (--reverse-input)
+func reverseLines(in <-chan inputLine) <-chan inputLine {
+	out := make(chan inputLine, cap(in))
+	go func() {
+		defer close(out)
+		var held []inputLine
+		send := func() {
+			for i := len(held) - 1; i >= 0; i-- {
+				out <- held[i]
+			}
+			held = held[:0]
+		}
+		for l := range in {
+			switch l.event {
+			case cycleStart:
+				out <- l
+			case cycleEnd:
+				send()
+				out <- l
+			default:
+				held = append(held, l)
+			}
+		}
+		send()
+	}()
+	return out
+}
+
+// replayLines returns a channel yielding held, then everything from rest
+func replayLines(held []inputLine, rest <-chan inputLine) <-chan inputLine {
+	out := make(chan inputLine, len(held))
+	for _, in := range held {
+		out <- in
+	}
+	go func() {
+		defer close(out)
+		for in := range rest {
+			out <- in
+		}
+	}()
+	return out
+}
+
+// collapsedMarker renders the --collapse-text marker for a run of n lines
+func collapsedMarker(text string, n int) string {
+	return strings.ReplaceAll(text, "{count}", strconv.Itoa(n))
+}
+
+// itemSize approximates the memory a buffered line takes, for --max-memory
+func itemSize(it item) int64 {
+	return int64(len(it.raw) + len(it.clean))
+}
+
+func bufferSize(buffer []item) int64 {
+	var n int64
+	for _, it := range buffer {
+		n += itemSize(it)
+	}
+	return n
+}
+
+// evictLowest drops buffered lines, lowest band first and newest first
+// within a band, until the rest takes at most limit bytes. It returns the
+// rest in its order, its size and how many lines were dropped.
+func evictLowest(buffer []item, used, limit int64) ([]item, int64, int) {
+	order := make([]int, len(buffer))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		pa, pb := buffer[order[a]].priority, buffer[order[b]].priority
+		if pa != pb {
+			return pa > pb
+		}
+		return order[a] > order[b]
+	})
+	drop := make([]bool, len(buffer))
+	dropped := 0
+	for _, i := range order {
+		if used <= limit {
+			break
+		}
+		used -= itemSize(buffer[i])
+		drop[i] = true
+		dropped++
+	}
+	rest := buffer[:0]
+	for i, it := range buffer {
+		if !drop[i] {
+			rest = append(rest, it)
+		}
+	}
+	return rest, used, dropped
+}
+
+// inputFlags leave lines and their order alone when there are no filters,
+// so --passthrough can still copy the input as is
+var inputFlags = []string{
+	"passthrough", "f", "i", "ignore-case", "w", "word-boundary-mode", "word-unicode",
+	"match-case", "sort-case", "color", "runes", "d", "delimiter", "tie-break",
+	"priority-wins", "priority-zero-wins", "score", "weights", "by-match-count",
+	"timeout", "idle-flush", "adaptive-flush", "deterministic", "initial-delay",
+	"input-buffer-size", "e", "exec-env", "exec-dir", "exec-stderr", "stdin",
+	"stdin-split", "strict-file-args", "filter-dir", "echo-comments",
+	"ignore-filter-errors", "quiet-errors", "always-exit-zero", "binary-safe",
+}
+
+// onlyInputFlags reports whether every flag in set is one of inputFlags
+func onlyInputFlags(set map[string]bool) bool {
+	for name := range set {
+		if !slices.Contains(inputFlags, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupRanks numbers the --group-by keys in buffer (in arrival order) by
+// --group-order: first-seen, size (most lines first, then first-seen) or
+// lexical
+func groupRanks(buffer []item, order string) map[string]int {
+	var keys []string
+	sizes := map[string]int{}
+	for _, it := range buffer {
+		if !it.grouped {
+			continue
+		}
+		if sizes[it.group] == 0 {
+			keys = append(keys, it.group)
+		}
+		sizes[it.group]++
+	}
+	switch order {
+	case "size":
+		sort.SliceStable(keys, func(i, j int) bool { return sizes[keys[i]] > sizes[keys[j]] })
+	case "lexical":
+		sort.Strings(keys)
+	}
+	ranks := make(map[string]int, len(keys))
+	for i, key := range keys {
+		ranks[key] = i
+	}
+	return ranks
+}
+
+// lineWriter writes output lines to stdout through the stages that only
+// apply there: --truncate, --prefix, --limit-bytes and --no-final-newline,
+// then --output-encoding and --tee-stderr. It is only used by the printer
+// goroutine, so both --tee-stderr copies get whole lines in the same order.
+type lineWriter struct {
+	cfg    *Config
+	out    io.Writer
+	closer io.Closer // Ends a stateful --output-encoding, if any
+	prefix string
+
+	// --limit-bytes: what's left of the byte budget, and whether it ran
+	// out; nothing is written after that
+	bytesLeft int64
+	bytesOut  bool
+
+	// With --no-final-newline each line's newline is held back until
+	// another line follows
+	pendingNewline bool
+}
+
+func newLineWriter(cfg *Config, enc encoding.Encoding) *lineWriter {
+	w := &lineWriter{cfg: cfg, out: os.Stdout, bytesLeft: int64(cfg.LimitBytes)}
+	if cfg.TeeStderr {
+		w.out = io.MultiWriter(os.Stdout, os.Stderr)
+	}
+	if enc != nil {
+		// Characters the charset lacks become its replacement character
+		w.out = encoding.ReplaceUnsupported(enc.NewEncoder()).Writer(w.out)
+		w.closer, _ = w.out.(io.Closer)
+	}
+	w.prefix = cfg.Prefix
+	if w.prefix != "" && cfg.PrefixColor != "" {
+		w.prefix = "\x1b[" + cfg.PrefixColor + "m" + w.prefix + highlightOff
+	}
+	return w
+}
+
+func (w *lineWriter) write(s string) {
+	// --truncate comes first, --prefix isn't cut
+	if w.cfg.Truncate > 0 {
+		s = truncateLines(s, w.cfg.Truncate)
+	}
+	// Every physical line of a --flatten=false record is prefixed
+	if w.prefix != "" {
+		s = w.prefix + strings.ReplaceAll(s, "\n", "\n"+w.prefix)
+	}
+	if !w.fits(s) {
+		return
 	}
+	if !w.cfg.NoFinalNewline {
+		fmt.Fprintln(w.out, s)
+		return
+	}
+	if w.pendingNewline {
+		fmt.Fprint(w.out, "\n")
+	}
+	fmt.Fprint(w.out, s)
+	w.pendingNewline = true
 }
 
-// Helpers
+// fits takes s and its newline out of the --limit-bytes budget, or reports
+// that it doesn't fit. With --byte-cut exact as much as fits is written.
+func (w *lineWriter) fits(s string) bool {
+	if w.cfg.LimitBytes <= 0 {
+		return true
+	}
+	if w.bytesOut {
+		return false
+	}
+	if int64(len(s))+1 > w.bytesLeft {
+		if w.cfg.ByteCut == "exact" {
+			fmt.Fprint(w.out, (s + "\n")[:w.bytesLeft])
+		}
+		w.bytesOut = true
+		return false
+	}
+	w.bytesLeft -= int64(len(s)) + 1
+	return true
+}
 
-func defineFlags(fs *flag.FlagSet, c *Config) {
-	fs.StringVar(&c.Filters, "f", "", "Comma separated list of prioritized strings")
-	fs.BoolVar(&c.OnlyMatching, "o", false, "Output only matching results")
-	fs.BoolVar(&c.Keep, "k", false, "")
-	fs.BoolVar(&c.Keep, "keep-going", false, "Output unsorted (unmatched) lines immediately")
-	fs.BoolVar(&c.IgnoreCase, "i", false, "")
-	fs.BoolVar(&c.IgnoreCase, "ignore-case", false, "Ignore case")
-	fs.IntVar(&c.Limit, "limit", 0, "Flush buffer after N prioritized matches")
-	fs.DurationVar(&c.Timeout, "timeout", 500*time.Millisecond, "Flush timeout")
-	fs.BoolVar(&c.Color, "color", false, "Enable color-aware mode")
-	fs.BoolVar(&c.WordBoundary, "w", false, "Match on word boundaries only")
-	fs.BoolVar(&c.VersionFlag, "version", false, "Display version and quit")
-	fs.StringVar(&c.Exec, "e", "", "Execute command and sort its output")
+// newCycle writes the control codes starting a --repeat cycle, which also
+// gets a fresh byte budget
+func (w *lineWriter) newCycle(codes string) {
+	fmt.Fprint(w.out, codes)
+	w.bytesLeft, w.bytesOut = int64(w.cfg.LimitBytes), false
+}
+
+func (w *lineWriter) close() {
+	if w.closer != nil {
+		w.closer.Close()
+	}
+}
+
+// bandFiles holds the --split-dir files, created on a band's first line
+type bandFiles struct {
+	dir   string
+	files map[int]*bandFile // nil entries failed to open
+}
+
+type bandFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func (b *bandFiles) write(priority int, line string) {
+	bf, ok := b.files[priority]
+	if !ok {
+		name := fmt.Sprintf("band-%d.txt", priority)
+		if priority == unmatchedPriority {
+			name = "unmatched.txt"
+		}
+		f, err := os.Create(filepath.Join(b.dir, name))
+		if err != nil {
+			warnf("Error creating split file: %v\n", err)
+		} else {
+			bf = &bandFile{f: f, w: bufio.NewWriter(f)}
+		}
+		b.files[priority] = bf
+	}
+	if bf != nil {
+		fmt.Fprintln(bf.w, line)
+	}
 }
 
-func applyFileConfig(dst *Config, src *Config, cliSet map[string]bool) {
-	if !cliSet["f"] {
-		dst.Filters = src.Filters
+func (b *bandFiles) close() {
+	for _, bf := range b.files {
+		if bf == nil {
+			continue
+		}
+		if err := bf.w.Flush(); err != nil {
+			warnf("Error writing split file: %v\n", err)
+		}
+		bf.f.Close()
 	}
-	if !cliSet["o"] {
-		dst.OnlyMatching = src.OnlyMatching
+}
+
+// ringSaveDelay is how long --output-ring lets lines pile up before
+// rewriting the file
+const ringSaveDelay = time.Second
+
+// ringFile keeps the last lines written in memory and rewrites the
+// --output-ring file with them shortly after each change
+type ringFile struct {
+	mu    sync.Mutex
+	path  string
+	lines []string // Ring of len --ring-size, oldest at next once full
+	next  int
+	full  bool
+	timer *time.Timer // Pending save, nil if none
+}
+
+func (r *ringFile) write(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = line
+	r.next++
+	if r.next == len(r.lines) {
+		r.next, r.full = 0, true
 	}
-	if !cliSet["k"] && !cliSet["keep-going"] {
-		dst.Keep = src.Keep
+	if r.timer == nil {
+		r.timer = time.AfterFunc(ringSaveDelay, r.save)
 	}
-	if !cliSet["limit"] {
-		dst.Limit = src.Limit
+}
+
+// save replaces the file through a rename, so readers never see it half
+// written
+func (r *ringFile) save() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timer = nil
+	var b strings.Builder
+	if r.full {
+		for _, l := range r.lines[r.next:] {
+			b.WriteString(l + "\n")
+		}
 	}
-	if !cliSet["i"] && !cliSet["ignore-case"] {
-		dst.IgnoreCase = src.IgnoreCase
+	for _, l := range r.lines[:r.next] {
+		b.WriteString(l + "\n")
 	}
-	if !cliSet["timeout"] {
-		dst.Timeout = src.Timeout
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		warnf("Error writing ring file: %v\n", err)
+		return
 	}
-	if !cliSet["color"] {
-		dst.Color = src.Color
+	if err := os.Rename(tmp, r.path); err != nil {
+		warnf("Error writing ring file: %v\n", err)
 	}
-	if !cliSet["w"] {
-		dst.WordBoundary = src.WordBoundary
+}
+
+func (r *ringFile) close() {
+	r.mu.Lock()
+	if r.timer != nil {
+		r.timer.Stop()
 	}
-	if !cliSet["e"] {
-		dst.Exec = src.Exec
+	r.mu.Unlock()
+	r.save()
+}
+
+// outputGate holds the output stages that can drop a line on its way to
+// the printer: --transitions, --squeeze and --rate's drop mode. Lines are
+// put through it before --limit counts them, so only printed lines count.
+type outputGate struct {
+	cfg       *Config
+	lastBand  int    // --transitions
+	lastLine  string // --squeeze, the previous rendered line
+	squeezing bool
+	bucket    *tokenBucket // --rate drop
+}
+
+func newOutputGate(cfg *Config) *outputGate {
+	g := &outputGate{cfg: cfg, lastBand: -1}
+	if cfg.Rate > 0 && cfg.RateOverflow == "drop" {
+		g.bucket = newTokenBucket(cfg.Rate, time.Now())
 	}
+	return g
 }
 
-func tokenize(input string) []string {
-	var args []string
-	var current strings.Builder
-	inQuote := false
-	quoteChar := rune(0)
+// reset starts a new --repeat cycle
+func (g *outputGate) reset() {
+	g.lastBand = -1
+	g.squeezing = false
+}
 
-	for _, r := range input {
-		switch {
-		case inQuote:
-			if r == quoteChar {
-				inQuote = false
-			} else {
-				current.WriteRune(r)
+// drop reports whether it is left out of the output
+func (g *outputGate) drop(it item) bool {
+	if g.cfg.Transitions && !it.marker {
+		if it.priority == g.lastBand {
+			return true
+		}
+		g.lastBand = it.priority
+	}
+	// --squeeze: drop a line identical to the one just printed; any
+	// marker in between breaks the run
+	if g.cfg.Squeeze {
+		if it.marker {
+			g.squeezing = false
+		} else {
+			key := render(it, g.cfg)
+			if g.cfg.SortCase == "fold" {
+				key = lowerCase(key)
 			}
-		case r == '"' || r == '\'':
-			inQuote = true
-			quoteChar = r
-		case r == ' ' || r == '\t':
-			if !inQuote {
-				if current.Len() > 0 {
-					args = append(args, current.String())
-					current.Reset()
-				}
-			} else {
-				current.WriteRune(r)
+			if g.squeezing && key == g.lastLine {
+				return true
 			}
-		default:
-			current.WriteRune(r)
+			g.lastLine, g.squeezing = key, true
 		}
 	}
-	if current.Len() > 0 {
-		args = append(args, current.String())
+	// --rate: flushes come in priority order, so the lines that get
+	// through first are the most important ones
+	if g.bucket != nil && !it.marker && !g.bucket.take(time.Now()) {
+		return true
 	}
-	return args
+	return false
+}
+
+// tokenBucket allows rate lines per second, with bursts of up to rate lines
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take uses up a token if one is available
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait uses up a token, returning how long to wait before it is available
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// pinSet holds the latest line of each pinned key with when it was last seen
+type pinSet struct {
+	ttl   time.Duration // 0 keeps lines forever
+	lines map[string]pinnedLine
+}
+
+type pinnedLine struct {
+	it   item
+	seen time.Time
+}
+
+func (p *pinSet) add(it item, now time.Time) {
+	p.lines[it.clean] = pinnedLine{it: it, seen: now}
+}
+
+func (p *pinSet) has(key string) bool {
+	_, ok := p.lines[key]
+	return ok
+}
+
+// active evicts lines not seen within the TTL and returns the rest sorted
+func (p *pinSet) active(now time.Time) []item {
+	var out []item
+	for key, pl := range p.lines {
+		if p.ttl > 0 && now.Sub(pl.seen) >= p.ttl {
+			delete(p.lines, key)
+			continue
+		}
+		out = append(out, pl.it)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].priority != out[j].priority {
+			return out[i].priority < out[j].priority
+		}
+		return out[i].clean < out[j].clean
+	})
+	return out
+}
+
+// stateVersion is the --state-file format version. Unknown fields are
+// ignored and missing ones start empty, so only incompatible changes bump it.
+const stateVersion = 1
+
+// stateMaxLines caps the line frequencies a --state-file keeps
+const stateMaxLines = 10000
+
+type savedState struct {
+	Version int                    `json:"version"`
+	Pins    []savedPin             `json:"pins,omitempty"`
+	Rates   map[string][]time.Time `json:"rates,omitempty"` // Recent matches by filter spec
+	Prior   map[string]int         `json:"prior,omitempty"` // Times each sort key was seen
+}
+
+type savedPin struct {
+	Raw      string    `json:"raw"`
+	Clean    string    `json:"clean"`
+	Priority int       `json:"priority"`
+	Filter   string    `json:"filter"`
+	Seen     time.Time `json:"seen"`
+}
+
+// readState loads a --state-file; a missing file is an empty state
+func readState(path string) (savedState, error) {
+	var st savedState
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(content, &st); err != nil {
+		return savedState{}, err
+	}
+	if st.Version != stateVersion {
+		return savedState{}, fmt.Errorf("unsupported version %d", st.Version)
+	}
+	return st, nil
+}
+
+// writeState replaces the --state-file through a rename, so a crash never
+// leaves it half written
+func writeState(path string, st savedState) error {
+	out, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// mergeCounts adds b to a, keeping the limit most frequent keys
+func mergeCounts(a, b map[string]int, limit int) map[string]int {
+	merged := maps.Clone(a)
+	if merged == nil {
+		merged = map[string]int{}
+	}
+	for key, n := range b {
+		merged[key] += n
+	}
+	if len(merged) <= limit {
+		return merged
+	}
+	keys := slices.SortedFunc(maps.Keys(merged), func(x, y string) int { return merged[y] - merged[x] })
+	for _, key := range keys[limit:] {
+		delete(merged, key)
+	}
+	return merged
+}
+
+// flushEvent is the --flush-events record of one flush
+type flushEvent struct {
+	Flush  int         `json:"flush"`
+	Lines  int         `json:"lines"`
+	Bands  []bandCount `json:"bands"`
+	Reason string      `json:"reason"`
+}
+
+type bandCount struct {
+	Band  int `json:"band"` // unmatchedPriority for unmatched lines
+	Lines int `json:"lines"`
+}
+
+// jsonNumber parses line as a JSON object and returns the number at the
+// dot-separated path, if there is one
+func jsonNumber(line, path string) (float64, bool) {
+	var v any
+	if err := json.Unmarshal([]byte(line), &v); err != nil {
+		return 0, false
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, false
+		}
+		v = obj[key]
+	}
+	n, ok := v.(float64)
+	return n, ok
+}
+
+// fieldNumber returns field n (1-based) of line as a --sort-numeric-field
+// key. A field that isn't a number sorts after all numbers, as +Inf; a
+// missing field has no key and sorts last.
+func fieldNumber(line, delim string, n int) (float64, bool) {
+	fields := splitFields(line, delim)
+	if n > len(fields) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(fields[n-1]), 64)
+	if err != nil || math.IsNaN(v) {
+		return math.Inf(1), true
+	}
+	return v, true
+}
+
+// writeFlushEvent writes a JSON line describing a flush of the sorted items
+func writeFlushEvent(w io.Writer, n int, reason string, emitted []item) {
+	ev := flushEvent{Flush: n, Lines: len(emitted), Bands: []bandCount{}, Reason: reason}
+	for _, it := range emitted {
+		if last := len(ev.Bands) - 1; last >= 0 && ev.Bands[last].Band == it.priority {
+			ev.Bands[last].Lines++
+			continue
+		}
+		ev.Bands = append(ev.Bands, bandCount{Band: it.priority, Lines: 1})
+	}
+	out, _ := json.Marshal(ev)
+	fmt.Fprintln(w, string(out))
+}
+
+// maxFilterWorkers caps the --filter-timeout workers, the live one and
+// those abandoned but still matching
+const maxFilterWorkers = 2
+
+// timedPicker runs pickFilter on a worker goroutine under --filter-timeout.
+// A worker that misses the deadline is left to finish on its own and a fresh
+// one takes the next line. At most maxFilterWorkers exist at a time: while
+// every one of them is stuck, lines are unmatched without being tried.
+type timedPicker struct {
+	filters []filter
+	cfg     *Config
+	jobs    chan pickJob // nil while no worker could be started
+	timer   *time.Timer
+	workers chan struct{} // One token per running worker
+	warned  bool          // The pool ran dry, warned once
+}
+
+type pickJob struct {
+	line string
+	done chan [2]int // Buffered, so an abandoned worker never blocks
+}
+
+func newTimedPicker(filters []filter, cfg *Config) *timedPicker {
+	p := &timedPicker{filters: filters, cfg: cfg, timer: time.NewTimer(cfg.FilterTimeout), workers: make(chan struct{}, maxFilterWorkers)}
+	p.timer.Stop()
+	p.start()
+	return p
+}
+
+// start launches a worker, unless maxFilterWorkers are still running
+func (p *timedPicker) start() bool {
+	select {
+	case p.workers <- struct{}{}:
+	default:
+		p.jobs = nil
+		return false
+	}
+	p.jobs = make(chan pickJob)
+	go func(jobs <-chan pickJob) {
+		defer func() { <-p.workers }()
+		for j := range jobs {
+			i, score := pickFilter(p.filters, j.line, p.cfg)
+			j.done <- [2]int{i, score}
+		}
+	}(p.jobs)
+	return true
+}
+
+// pick returns pickFilter's result, or ok false (and no match) on timeout.
+// A line that finds no worker is unmatched too, but ok is true: the only
+// warning for it is the one pick gives the first time.
+func (p *timedPicker) pick(line string) (int, int, bool) {
+	if p.jobs == nil && !p.start() {
+		if !p.warned {
+			warnf("Filter workers stuck past --filter-timeout, treating lines as unmatched until one finishes\n")
+			p.warned = true
+		}
+		return -1, 0, true
+	}
+	done := make(chan [2]int, 1)
+	p.jobs <- pickJob{line: line, done: done}
+	p.timer.Reset(p.cfg.FilterTimeout)
+	select {
+	case r := <-done:
+		p.timer.Stop()
+		return r[0], r[1], true
+	case <-p.timer.C:
+		close(p.jobs)
+		p.start()
+		return -1, 0, false
+	}
+}
+
+// freqCounter counts lines by sort key for --min-freq, remembering the first
+// line of each key
+type freqCounter struct {
+	index  map[string]int
+	items  []item
+	counts []int
+	latest bool // Keep the most recent line of each key, not the first
+}
+
+func (f *freqCounter) add(it item) {
+	if i, ok := f.index[it.clean]; ok {
+		f.counts[i]++
+		if f.latest {
+			f.items[i] = it
+		}
+		return
+	}
+	f.index[it.clean] = len(f.items)
+	f.items = append(f.items, it)
+	f.counts = append(f.counts, 1)
+}
+
+// frequent returns the lines seen at least threshold times, prefixed with
+// their count
+func (f *freqCounter) frequent(threshold int) []item {
+	var out []item
+	for i, it := range f.items {
+		if f.counts[i] >= threshold {
+			it.raw = fmt.Sprintf("%d\t%s", f.counts[i], it.raw)
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// ranked is frequent ordered by count, highest first, for
+// --dedupe-by-fingerprint
+func (f *freqCounter) ranked(threshold int) []item {
+	var order []int
+	for i := range f.items {
+		if f.counts[i] >= threshold {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return f.counts[order[a]] > f.counts[order[b]] })
+	out := make([]item, 0, len(order))
+	for _, i := range order {
+		it := f.items[i]
+		it.raw = fmt.Sprintf("%d\t%s", f.counts[i], it.raw)
+		out = append(out, it)
+	}
+	return out
+}
+
+// ratioWindow tracks which of the last N lines were unmatched
+type ratioWindow struct {
+	unmatched []bool
+	next      int
+	full      bool
+	count     int
+}
+
+func newRatioWindow(size int) *ratioWindow {
+	return &ratioWindow{unmatched: make([]bool, size)}
+}
+
+// add records a line and returns the unmatched fraction of the window, or 0
+// until the window has filled up
+func (w *ratioWindow) add(unmatched bool) float64 {
+	if w.unmatched[w.next] {
+		w.count--
+	}
+	w.unmatched[w.next] = unmatched
+	if unmatched {
+		w.count++
+	}
+	w.next = (w.next + 1) % len(w.unmatched)
+	if w.next == 0 {
+		w.full = true
+	}
+	if !w.full {
+		return 0
+	}
+	return float64(w.count) / float64(len(w.unmatched))
+}
+
+// ring keeps the last N pushed lines
+type ring struct {
+	buf  []inputLine
+	next int
+	full bool
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([]inputLine, size)}
+}
+
+func (r *ring) push(line inputLine) {
+	r.buf[r.next] = line
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// lines returns the kept lines, oldest first
+func (r *ring) lines() []inputLine {
+	if !r.full {
+		return r.buf[:r.next]
+	}
+	return append(r.buf[r.next:], r.buf[:r.next]...)
+}
+
+// newCommand tokenizes a command line, expanding ~ and $VAR in each token.
+// Returns nil for an empty command line.
+func newCommand(ctx context.Context, cmdline string) *exec.Cmd {
+	tokens := tokenize(cmdline)
+	if len(tokens) == 0 {
+		return nil
+	}
+	for i := range tokens {
+		tokens[i] = expand(tokens[i])
+	}
+	return exec.CommandContext(ctx, tokens[0], tokens[1:]...)
+}
+
+// coprocessTimeout is how long a --transform-cmd reply may take before the
+// command is given up on
+const coprocessTimeout = 5 * time.Second
+
+// coprocess is a long-lived command transforming lines one at a time
+type coprocess struct {
+	cmdline string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	replies chan string // Closed when the command's stdout ends
+	timer   *time.Timer // coprocessTimeout for each line
+	dead    bool
+}
+
+func startCoprocess(cmdline string) (*coprocess, error) {
+	cmd := newCommand(context.Background(), cmdline)
+	if cmd == nil {
+		return nil, fmt.Errorf("empty command")
+	}
+	if !quietErrors {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &coprocess{cmdline: cmdline, cmd: cmd, stdin: stdin, replies: make(chan string), timer: time.NewTimer(coprocessTimeout)}
+	c.timer.Stop()
+	go func() {
+		defer close(c.replies)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+		for scanner.Scan() {
+			c.replies <- scanner.Text()
+		}
+		cmd.Wait()
+	}()
+	return c, nil
+}
+
+// apply returns the command's reply to line. Once the command fails, exits or
+// stops answering, it is killed and lines are passed through untransformed.
+// The timeout covers writing the line too, as a command that stops reading
+// blocks the write once the pipe is full.
+func (c *coprocess) apply(line string) string {
+	if c.dead {
+		return line
+	}
+	fail := func(why string) string {
+		c.timer.Stop()
+		c.dead = true
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		warnf("Transform command '%s' %s, matching untransformed lines\n", c.cmdline, why)
+		return line
+	}
+	c.timer.Reset(coprocessTimeout)
+	written := make(chan error, 1) // Buffered, so a stuck write never blocks
+	go func() {
+		_, err := io.WriteString(c.stdin, line+"\n")
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			return fail("stopped reading")
+		}
+	case <-c.timer.C:
+		return fail("didn't answer")
+	}
+	select {
+	case reply, ok := <-c.replies:
+		if !ok {
+			return fail("exited")
+		}
+		c.timer.Stop()
+		return reply
+	case <-c.timer.C:
+		return fail("didn't answer")
+	}
+}
+
+// collapseBands merges the matched lines of a sorted buffer past the first n
+// distinct priorities into one band, with the priority of the first of them,
+// sorted by line. It reports whether there were more than n bands.
+func collapseBands(buffer []item, n int) bool {
+	bands := 0
+	for i := range buffer {
+		if buffer[i].priority == unmatchedPriority {
+			return false
+		}
+		if i > 0 && buffer[i].priority == buffer[i-1].priority {
+			continue
+		}
+		if bands++; bands <= n {
+			continue
+		}
+		end := i
+		for end < len(buffer) && buffer[end].priority != unmatchedPriority {
+			buffer[end].priority = buffer[i].priority
+			end++
+		}
+		merged := buffer[i:end]
+		sort.SliceStable(merged, func(a, b int) bool { return merged[a].clean < merged[b].clean })
+		return true
+	}
+	return false
+}
+
+// compareBands reorders each band (run of equal priority) of a sorted buffer
+// with an external command. The band's lines are written to its stdin, one
+// per line, and it must print them back in the desired order. Printed lines
+// that aren't in the band are ignored, band lines it leaves out keep their
+// default order after the ones it printed. On failure the default order stays.
+func compareBands(buffer []item, cmdline string) {
+	for start := 0; start < len(buffer); {
+		end := start + 1
+		for end < len(buffer) && buffer[end].priority == buffer[start].priority {
+			end++
+		}
+		if end-start > 1 {
+			if err := compareBand(buffer[start:end], cmdline); err != nil {
+				warnf("Error running compare command '%s': %v\n", cmdline, err)
+			}
+		}
+		start = end
+	}
+}
+
+func compareBand(band []item, cmdline string) error {
+	cmd := newCommand(context.Background(), cmdline)
+	if cmd == nil {
+		return fmt.Errorf("empty command")
+	}
+	var in bytes.Buffer
+	for _, it := range band {
+		in.WriteString(it.raw)
+		in.WriteByte('\n')
+	}
+	cmd.Stdin = &in
+	if !quietErrors {
+		cmd.Stderr = os.Stderr
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	// Map printed lines back to items, duplicates in input order
+	pending := make(map[string][]int)
+	for i, it := range band {
+		pending[it.raw] = append(pending[it.raw], i)
+	}
+	ordered := make([]item, 0, len(band))
+	used := make([]bool, len(band))
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		idx := pending[line]
+		if len(idx) == 0 {
+			continue
+		}
+		pending[line] = idx[1:]
+		ordered = append(ordered, band[idx[0]])
+		used[idx[0]] = true
+	}
+	for i, it := range band {
+		if !used[i] {
+			ordered = append(ordered, it)
+		}
+	}
+	copy(band, ordered)
+	return nil
 }
 
 // expand handles environment variable expansion ($VAR) and tilde expansion (~/ or ~)
@@ -470,3 +5372,12 @@ func expand(path string) string {
 	}
 	return expanded
 }
+
+// seekableStdin reports whether input comes from a regular file redirected to stdin.
+func seekableStdin(cfg Config) bool {
+	if cfg.Exec != "" {
+		return false
+	}
+	st, err := os.Stdin.Stat()
+	return err == nil && st.Mode().IsRegular()
+}
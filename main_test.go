@@ -192,3 +192,1672 @@ func TestLimitOnHighPriority(t *testing.T) {
 	CheckNumberOfLines(t, got, 1)
 	CheckString(t, got, expected)
 }
+
+func TestTailLines(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'WARN' --tail-lines 2", testFile, binName)
+	expected := `
+WARN: INFO_PAD not found
+WARN: memory high
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestURLDecode(t *testing.T) {
+	cmd := fmt.Sprintf("printf '%%s\\n' 'GET /a' 'GET /search%%3Fq%%3Dfoo' | ./%s -f '?q=foo' -o --url-decode", binName)
+	expected := `GET /search%3Fq%3Dfoo`
+
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestHead(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'ERROR' -o --head 1", testFile, binName)
+	expected := `
+DEBUG: connection established
+ERROR: critical failure in info db
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestAdaptiveFlush(t *testing.T) {
+	// 900 buffered lines cut the 3s timeout to 300ms, so they're flushed
+	// before the last line arrives
+	cmd := fmt.Sprintf("(seq 900; sleep 1; echo 0) | ./%s --timeout 3s --adaptive-flush | head -1", binName)
+	CheckString(t, runPipeline(t, cmd), "1")
+
+	cmd = fmt.Sprintf("(seq 900; sleep 1; echo 0) | ./%s --timeout 3s | head -1", binName)
+	CheckString(t, runPipeline(t, cmd), "0")
+}
+
+func TestSyslogFlags(t *testing.T) {
+	cmd := fmt.Sprintf("echo a | ./%s --syslog --syslog-tag '' 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --syslog-tag: must not be empty")
+
+	cmd = fmt.Sprintf("echo a | ./%s --syslog --split-dir syslog.d 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "--syslog conflicts with --split-dir")
+}
+
+func TestUnmatchedFile(t *testing.T) {
+	out := "unmatched_test.txt"
+	defer os.Remove(out)
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'WARN' --unmatched-file %s", testFile, binName, out)
+
+	got := runPipeline(t, cmd)
+	CheckNumberOfLines(t, got, 2)
+
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("reading unmatched file: %v", err)
+	}
+	CheckNumberOfLines(t, string(content), testFileLines-2)
+	CheckPrefix(t, string(content), "DEBUG: connection established")
+}
+
+func TestDropEmpty(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\n\\033[0m\\n  \\na\\n' | ./%s --color --drop-empty", binName)
+	expected := `
+a
+b
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestTieBreakLastListed(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'INFO_PAD,INFO,DEBUG' -o --tie-break lastlisted", testFile, binName)
+	expected := `
+INFO: errorneous data found
+INFO: starting service
+WARN: INFO_PAD not found
+DEBUG: connection established
+DEBUG: payload received
+	`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestFlushCap(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'ERROR,WARN' --flush-cap 2", testFile, binName)
+	expected := `
+ERROR: critical failure in info db
+WARN: INFO_PAD not found
+WARN: memory high
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+
+	// Carried lines still come out at EOF, a capped flush at a time
+	cmd = fmt.Sprintf("printf 'a\\nb\\nc\\nd\\ne\\n' | ./%s --flush-cap 2 --flush-cap-carry", binName)
+	CheckString(t, runPipeline(t, cmd), "a\nb\nc\nd\ne")
+}
+
+func TestExclude(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'INFO' -o --exclude 'service' --exclude 'db,pad' -i", testFile, binName)
+	expected := `
+INFO: errorneous data found
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestMatchReversed(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a.txt\\nb.txt.log\\nżółw.log\\n' | ./%s -f 'gol.' -o --match-reversed", binName)
+	expected := `
+b.txt.log
+żółw.log
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestExecStderrMerge(t *testing.T) {
+	cmd := fmt.Sprintf(`./%s -e "sh -c 'echo out; echo ERROR err >&2'" -f ERROR --exec-stderr merge 2>/dev/null`, binName)
+	expected := `
+ERROR err
+out
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestExecStderrDrop(t *testing.T) {
+	cmd := fmt.Sprintf(`./%s -e "sh -c 'echo out; echo ERROR err >&2'" -f ERROR --exec-stderr drop`, binName)
+	expected := `out`
+
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestDeterministic(t *testing.T) {
+	cmd := fmt.Sprintf("(echo b; sleep 0.3; echo a) | ./%s --timeout 50ms --deterministic", binName)
+	expected := `
+a
+b
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestStats(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'ERROR,WARN' --stats 2>&1 >/dev/null", testFile, binName)
+	expected := `
+FILTER       PRIORITY  MATCHES  PERCENT
+(unmatched)  -         4        57.1%
+WARN         1         2        28.6%
+ERROR        0         1        14.3%
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+
+	// A priority= filter line shows its own band, not its position
+	cmd = fmt.Sprintf("printf 'pattern=WARN priority=0\\npattern=ERROR priority=3\\n' > stats.filters; printf 'ERROR a\\nWARN b\\nWARN c\\nx\\n' | ./%s --stats stats.filters 2>&1 >/dev/null; rm -f stats.filters", binName)
+	expected = `
+FILTER       PRIORITY  MATCHES  PERCENT
+lit:WARN     0         2        50.0%
+lit:ERROR    3         1        25.0%
+(unmatched)  -         1        25.0%
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	// So does pattern@priority; equal counts go in band order
+	cmd = fmt.Sprintf("printf 'ERROR a\\nWARN b\\nx\\n' | ./%s --stats -- ERROR@5 WARN 2>&1 >/dev/null", binName)
+	expected = `
+FILTER       PRIORITY  MATCHES  PERCENT
+WARN         1         1        33.3%
+ERROR        5         1        33.3%
+(unmatched)  -         1        33.3%
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestCompressedInput(t *testing.T) {
+	for _, tool := range []string{"gzip", "bzip2", "zstd"} {
+		t.Run(tool, func(t *testing.T) {
+			if _, err := exec.LookPath(tool); err != nil {
+				t.Skipf("%s not installed", tool)
+			}
+			cmd := fmt.Sprintf("%s -c < %s | ./%s -f 'ERROR' -o", tool, testFile, binName)
+			expected := `ERROR: critical failure in info db`
+
+			got := runPipeline(t, cmd)
+			CheckString(t, got, expected)
+		})
+	}
+}
+
+func TestQuietErrors(t *testing.T) {
+	cmd := fmt.Sprintf(`./%s -e "sh -c 'echo out; echo noise >&2'" --quiet-errors 2>&1`, binName)
+	expected := `out`
+
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestInlineFilterModes(t *testing.T) {
+	cmd := fmt.Sprintf(`grep '.' %s | ./%s -f 're:^W.*high$,glob:D*payload,lit:INFO' -o`, testFile, binName)
+	expected := `
+WARN: memory high
+DEBUG: payload received
+INFO: errorneous data found
+INFO: starting service
+WARN: INFO_PAD not found
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestFlushMarker(t *testing.T) {
+	cmd := fmt.Sprintf("(echo b; echo a; sleep 0.3; echo c) | ./%s --timeout 100ms --flush-marker '--'", binName)
+	expected := `
+a
+b
+--
+c
+--
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestIgnoreFilterErrors(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 're:(,ERROR,WARN' -o --ignore-filter-errors 2>/dev/null", testFile, binName)
+	expected := `
+ERROR: critical failure in info db
+WARN: INFO_PAD not found
+WARN: memory high
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestScore(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'info,data,db' --weights 1,2,5 -i -o --score", testFile, binName)
+	expected := `
+ERROR: critical failure in info db
+INFO: errorneous data found
+INFO: starting service
+WARN: INFO_PAD not found
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestUnbufferedInput(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'ERROR,WARN' --input-buffer-size 0", testFile, binName)
+	expected := `ERROR: critical failure in info db
+WARN: INFO_PAD not found
+WARN: memory high
+`
+	got := runPipeline(t, cmd)
+	CheckNumberOfLines(t, got, testFileLines)
+	CheckPrefix(t, got, expected)
+}
+
+func TestFieldFilter(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f '1:INFO: && 3:data,1:WARN: && 2:re:^m' -o", testFile, binName)
+	expected := `
+INFO: errorneous data found
+WARN: memory high
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestNoSortHighlight(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'warn,info' -i --no-sort --highlight | head -3", testFile, binName)
+	expected := "DEBUG: connection established\n" +
+		"\x1b[1;31mINFO\x1b[0m: starting service\n" +
+		"ERROR: critical failure in \x1b[1;31minfo\x1b[0m db"
+
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestRepeat(t *testing.T) {
+	cmd := fmt.Sprintf(`timeout -s INT 0.35 ./%s -e "printf 'b\na\n'" --repeat 100ms || true`, binName)
+
+	got := runPipeline(t, cmd)
+	if n := strings.Count(got, "\x1b[H\x1b[2Ja\nb"); n < 2 {
+		t.Errorf("\nExpected at least 2 sorted cycles, got %d:\n%q", n, got)
+	}
+}
+
+func TestVersionJSON(t *testing.T) {
+	cmd := fmt.Sprintf("./%s --version-json", binName)
+
+	got := runPipeline(t, cmd)
+	CheckPrefix(t, got, `{"version":"v0.0.2","go":"go`)
+}
+
+func TestCompareCmd(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'ERROR,INFO' -o --compare-cmd 'sort -r'", testFile, binName)
+	expected := `
+ERROR: critical failure in info db
+WARN: INFO_PAD not found
+INFO: starting service
+INFO: errorneous data found
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestRateBoost(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'c1\\nb1\\nb2\\nb3\\nc\\na\\n' | ./%s -f 'a,b,c' --rate-window 1m --rate-threshold 2", binName)
+	expected := `
+b3
+a
+b1
+b2
+c
+c1
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestStdinSplit(t *testing.T) {
+	cmd := fmt.Sprintf("(printf 'WARN\\nERROR\\n---\\n'; cat %s) | ./%s --stdin-split '---' -o", testFile, binName)
+	expected := `
+WARN: INFO_PAD not found
+WARN: memory high
+ERROR: critical failure in info db
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestCountLines(t *testing.T) {
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'INFO,WARN' -o --count-lines", testFile, binName)
+
+	got := runPipeline(t, cmd)
+	CheckString(t, got, "4")
+}
+
+func TestHyperlinks(t *testing.T) {
+	input := `printf 'src/main.go:12:3: ERROR here\nratio 1.5:2 ERROR\n'`
+
+	// Not a terminal: left alone
+	got := runPipeline(t, fmt.Sprintf("%s | ./%s -f ERROR --hyperlinks", input, binName))
+	CheckString(t, got, "src/main.go:12:3: ERROR here\nratio 1.5:2 ERROR")
+
+	if _, err := exec.LookPath("script"); err != nil {
+		t.Skip("script not installed")
+	}
+	got = runPipeline(t, fmt.Sprintf(`script -qec "%s | ./%s -f ERROR --hyperlinks" /dev/null`, input, binName))
+	CheckContains(t, got, "/src/main.go\x1b\\src/main.go:12:3\x1b]8;;\x1b\\: ERROR here")
+	CheckContains(t, got, "ratio 1.5:2 ERROR")
+}
+
+func TestStickyPriority(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a\\nERROR x\\n  at y\\n\\nb\\n' | ./%s -f ERROR -o --sticky-priority", binName)
+	expected := `
+ERROR x
+  at y
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestAlign(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b,22,x\\na,1,yy\\nccc,3,z\\n' | ./%s -d , --align", binName)
+	expected := `
+a,    1,   yy
+b,    22,  x
+ccc,  3,   z
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestDropUnmatched(t *testing.T) {
+	out := "dropped_test.txt"
+	defer os.Remove(out)
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'WARN' -k --drop-unmatched --unmatched-file %s", testFile, binName, out)
+	expected := `
+WARN: INFO_PAD not found
+WARN: memory high
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+
+	content, _ := os.ReadFile(out)
+	CheckString(t, string(content), "")
+}
+
+func TestMinFields(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a,b,c\\nbroken\\nd,e,f\\ng,h\\n' | ./%s -d , --min-fields 3 -f 'zzz'", binName)
+	expected := `
+broken
+g,h
+a,b,c
+d,e,f
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestShowKey(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b%%%%20x\\nERROR a\\nc\\n' | ./%s -f 'ERROR' --url-decode --show-key", binName)
+	expected := "\n0:ERROR a\tERROR a\n999999:b x\tb%20x\n999999:c\tc\n"
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestMaxFlushes(t *testing.T) {
+	cmd := fmt.Sprintf("(printf 'b\\na\\n'; sleep 1; printf 'd\\nc\\n'; sleep 1; printf 'e\\n') | ./%s -f 'zzz' --timeout 300ms --max-flushes 1", binName)
+	expected := `
+a
+b
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestRunes(t *testing.T) {
+	// "éé" is 4 bytes but 2 runes, "abc" is 3 of each
+	tests := []struct {
+		flags    string
+		expected string
+	}{
+		{"-f 'abc,éé'", "\n1:éé abc\téé abc\n"},
+		{"-f 'abc,éé' --runes", "\n0:éé abc\téé abc\n"},
+		{"-f 'abc,glob:é*é'", "\n1:éé abc\téé abc\n"},
+		{"-f 'abc,glob:é*é' --runes", "\n0:éé abc\téé abc\n"},
+		{"-f 'abc,re:é+'", "\n1:éé abc\téé abc\n"},
+		{"-f 'abc,re:é+' --runes", "\n0:éé abc\téé abc\n"},
+	}
+	for _, tt := range tests {
+		cmd := fmt.Sprintf("printf 'éé abc\\n' | ./%s %s --show-key", binName, tt.flags)
+		got := runPipeline(t, cmd)
+		CheckString(t, got, tt.expected)
+	}
+}
+
+func TestEchoComments(t *testing.T) {
+	filterFile := "echo_comments_test.txt"
+	defer os.Remove(filterFile)
+	os.WriteFile(filterFile, []byte("# Errors\nERROR\n# Warnings\n\nWARN\n"), 0644)
+
+	cmd := fmt.Sprintf("printf 'x\\nWARN a\\nERROR b\\nWARN c\\n' | ./%s --echo-comments %s", binName, filterFile)
+	expected := `
+# Errors
+ERROR b
+# Warnings
+WARN a
+WARN c
+x
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestDedupWindow(t *testing.T) {
+	cmd := fmt.Sprintf("printf '10:00 ERROR db down\\n10:01 ERROR db down\\n10:02 ERROR disk full\\n10:03 INFO ok\\n10:04 INFO ok\\n' | ./%s -f 'ERROR' --dedup-window 1m --dedup-key 'ERROR (.*)'", binName)
+	expected := `
+10:00 ERROR db down
+10:02 ERROR disk full
+10:03 INFO ok
+10:04 INFO ok
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestUnmatchedSort(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{"lexical", "\nERR z\n10 b\n2 c\n9 a\nx\n"},
+		{"numeric", "\nERR z\n2 c\n9 a\n10 b\nx\n"},
+		{"reverse", "\nERR z\nx\n9 a\n2 c\n10 b\n"},
+		{"arrival", "\nERR z\n10 b\n9 a\nx\n2 c\n"},
+		{"newest", "\nERR z\n2 c\nx\n9 a\n10 b\n"},
+	}
+	for _, tt := range tests {
+		cmd := fmt.Sprintf("printf '10 b\\n9 a\\nx\\nERR z\\n2 c\\n' | ./%s -f 'ERR' --unmatched-sort %s", binName, tt.mode)
+		got := runPipeline(t, cmd)
+		CheckString(t, got, tt.expected)
+	}
+}
+
+func TestWordBoundaryMode(t *testing.T) {
+	input := "printf 'café bar\\ncaféine\\nnaïve x\\nnaïvex\\n'"
+
+	cmd := fmt.Sprintf("%s | ./%s -o -w -f 'café'", input, binName)
+	CheckString(t, runPipeline(t, cmd), "\ncaféine\n")
+
+	cmd = fmt.Sprintf("%s | ./%s -o -w --word-boundary-mode unicode -f 'café,re:na.ve'", input, binName)
+	expected := `
+café bar
+naïve x
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestAlwaysExitZero(t *testing.T) {
+	cmd := fmt.Sprintf("./%s --tie-break nope < /dev/null 2>/dev/null; echo $?", binName)
+	CheckString(t, runPipeline(t, cmd), "\n1\n")
+
+	cmd = fmt.Sprintf("./%s --always-exit-zero --tie-break nope < /dev/null 2>/dev/null; echo $?", binName)
+	CheckString(t, runPipeline(t, cmd), "\n0\n")
+}
+
+func TestNearFilter(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'ERROR far away from the timeout\\nnone\\ntimeout then ERROR\\nERROR timeout\\nERROR x timeout ERROR\\n' | ./%s -o -f 'near(ERROR,timeout,6),none'", binName)
+	expected := `
+timeout then ERROR
+ERROR timeout
+ERROR x timeout ERROR
+none
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestTransitions(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'ok 1\\nok 2\\nERROR a\\nERROR b\\nok 3\\nWARN c\\nWARN d\\n' | ./%s -f 'ERROR,WARN' --no-sort --transitions", binName)
+	expected := `
+ok 1
+ERROR a
+ok 3
+WARN c
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestFilterDir(t *testing.T) {
+	dir := "filter_dir_test"
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir, 0755)
+	os.WriteFile(dir+"/10-warn", []byte("# warnings\nWARN\n"), 0644)
+	os.WriteFile(dir+"/00-critical", []byte("FATAL\n\nERROR\n"), 0644)
+	os.WriteFile(dir+"/.hidden", []byte("INFO\n"), 0644)
+
+	cmd := fmt.Sprintf("printf 'WARN a\\nINFO b\\nERROR c\\nFATAL d\\n' | ./%s -o --filter-dir %s", binName, dir)
+	expected := `
+FATAL d
+ERROR c
+WARN a
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestTrimPrefixSuffix(t *testing.T) {
+	// Sorting still uses the full line: "a1 ..." comes before "b0 ..."
+	cmd := fmt.Sprintf("printf 'b0 host2 x [req=2]\\na1 host1 z [req=1]\\n' | ./%s --trim-prefix '\\S+ \\S+ ' --trim-suffix ' \\[req=\\d+\\]'", binName)
+	expected := `
+z
+x
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("printf '\\033[32m2024 ERROR\\033[0m y\\n' | ./%s --color --trim-prefix '\\d+ '", binName)
+	CheckString(t, runPipeline(t, cmd), "\n\x1b[32mERROR\x1b[0m y\n")
+}
+
+func TestKeepLabel(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a\\nERROR b\\nc\\n' | ./%s -k -f 'ERROR' --keep-label '> '", binName)
+	expected := `
+> a
+ERROR b
+> c
+`
+	got := runPipeline(t, cmd)
+	CheckString(t, got, expected)
+}
+
+func TestLineLength(t *testing.T) {
+	input := "printf 'a\\n\\nabc\\nabcdefgh\\nżółw\\n'"
+
+	cmd := fmt.Sprintf("%s | ./%s --min-line-length 2 --max-line-length 5", input, binName)
+	CheckString(t, runPipeline(t, cmd), "\nabc\n")
+
+	cmd = fmt.Sprintf("%s | ./%s --min-line-length 2 --max-line-length 5 --runes", input, binName)
+	CheckString(t, runPipeline(t, cmd), "\nabc\nżółw\n")
+}
+
+func TestOnlyCapture(t *testing.T) {
+	input := "printf 'user=bob ERROR x\\nuser=al WARN y\\nplain\\n'"
+
+	cmd := fmt.Sprintf("%s | ./%s -f 're:user=(\\w+) ERROR,WARN' --only-capture 1", input, binName)
+	expected := `
+bob
+user=al WARN y
+plain
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("%s | ./%s -f 're:user=(\\w+) ERROR,WARN' --only-capture 1 --capture-fallback drop", input, binName)
+	CheckString(t, runPipeline(t, cmd), "\nbob\n")
+}
+
+func TestUnmatchedRatioLimit(t *testing.T) {
+	cmd := fmt.Sprintf("(printf 'ERR 1\\n'; seq 1 20; printf 'ERR 2\\n') | ./%s -f 'ERR' --unmatched-ratio-limit 0.9 --unmatched-ratio-window 10 2>/dev/null", binName)
+	expected := `
+ERR 1
+ERR 2
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	// Below the limit nothing is dropped
+	cmd = fmt.Sprintf("(printf 'ERR 1\\n'; seq 1 5) | ./%s -f 'ERR' --unmatched-ratio-limit 0.9 --unmatched-ratio-window 10", binName)
+	CheckNumberOfLines(t, runPipeline(t, cmd), 6)
+}
+
+func TestSplitDir(t *testing.T) {
+	dir := "split_dir_test"
+	defer os.RemoveAll(dir)
+
+	cmd := fmt.Sprintf("printf 'a\\nERROR b\\nd\\nERROR e\\n' | ./%s -f 'ERROR,WARN' --split-dir %s", binName, dir)
+	CheckString(t, runPipeline(t, cmd), "")
+
+	band0, _ := os.ReadFile(dir + "/band-0.txt")
+	CheckString(t, strings.TrimSpace(string(band0)), "\nERROR b\nERROR e\n")
+	unmatched, _ := os.ReadFile(dir + "/unmatched.txt")
+	CheckString(t, strings.TrimSpace(string(unmatched)), "\na\nd\n")
+	if _, err := os.Stat(dir + "/band-1.txt"); err == nil {
+		t.Error("band-1.txt created for an empty band")
+	}
+
+	cmd = fmt.Sprintf("printf 'a\\nERROR b\\n' | ./%s -f 'ERROR' --split-dir %s --split-tee", binName, dir)
+	CheckString(t, runPipeline(t, cmd), "\nERROR b\na\n")
+}
+
+func TestNoFinalNewline(t *testing.T) {
+	// The trailing | shows exactly how the output ends
+	cmd := fmt.Sprintf("printf 'b\\nERROR a\\n' | ./%s -f 'ERROR'; printf '|'", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR a\nb\n|")
+
+	cmd = fmt.Sprintf("printf 'b\\nERROR a\\n' | ./%s -f 'ERROR' --no-final-newline; printf '|'", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR a\nb|")
+
+	cmd = fmt.Sprintf("printf '' | ./%s --no-final-newline; printf '|'", binName)
+	CheckString(t, runPipeline(t, cmd), "|")
+}
+
+func TestFingerprint(t *testing.T) {
+	input := "printf 'user 456 failed\\nuser 123 failed\\nuser 9 ok\\nuser 1 failed\\n'"
+
+	// Input order survives within a template
+	cmd := fmt.Sprintf("%s | ./%s --fingerprint '[0-9]+'", input, binName)
+	expected := `
+user 456 failed
+user 123 failed
+user 1 failed
+user 9 ok
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("%s | ./%s --fingerprint '[0-9]+' --dedup-window 1m", input, binName)
+	expected = `
+user 456 failed
+user 9 ok
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestFinalTie(t *testing.T) {
+	input := "printf '\\033[32mx\\033[0m\\n\\033[31mx\\033[0m\\n'"
+
+	cmd := fmt.Sprintf("%s | ./%s --color", input, binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[32mx\x1b[0m\n\x1b[31mx\x1b[0m")
+
+	cmd = fmt.Sprintf("%s | ./%s --color --final-tie raw", input, binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[31mx\x1b[0m\n\x1b[32mx\x1b[0m")
+}
+
+func TestMinFreq(t *testing.T) {
+	input := "printf 'user 1 failed\\nERROR a\\nuser 2 failed\\nERROR a\\nonce\\nuser 3 failed\\n'"
+
+	cmd := fmt.Sprintf("%s | ./%s -f 'ERROR' --min-freq 2 --fingerprint '[0-9]+'", input, binName)
+	expected := "2\tERROR a\n3\tuser 1 failed"
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("%s | ./%s -o -f 'ERROR' --min-freq 2", input, binName)
+	CheckString(t, runPipeline(t, cmd), "2\tERROR a")
+}
+
+func TestExecEnv(t *testing.T) {
+	cmd := fmt.Sprintf("SSORT_B=outer ./%s --exec-env SSORT_A=1 --exec-env 'SSORT_C=x=y' -e 'env' -o -f 'SSORT_' | sort", binName)
+	expected := `
+SSORT_A=1
+SSORT_B=outer
+SSORT_C=x=y
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("./%s --exec-env NOPE -e 'env' 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --exec-env 'NOPE'")
+}
+
+func TestExecDir(t *testing.T) {
+	cmd := fmt.Sprintf("./%s --exec-dir /tmp -e 'pwd'", binName)
+	CheckString(t, runPipeline(t, cmd), "/tmp")
+
+	cmd = fmt.Sprintf("./%s --exec-dir ./no-such-dir -e 'pwd' 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --exec-dir './no-such-dir'")
+}
+
+func TestPriorityZeroWins(t *testing.T) {
+	// "ERROR: critical" is longer than "ERROR", so it wins by default
+	cmd := fmt.Sprintf("grep ERROR %s | ./%s -f 'ERROR,ERROR: critical' --show-key", testFile, binName)
+	CheckPrefix(t, runPipeline(t, cmd), "1:")
+
+	cmd = fmt.Sprintf("grep ERROR %s | ./%s -f 'ERROR,ERROR: critical' --show-key --priority-zero-wins", testFile, binName)
+	CheckPrefix(t, runPipeline(t, cmd), "0:")
+}
+
+// BenchmarkPickFilter scans the test data, scaled up, against a long filter
+// list whose first filter matches most lines
+func BenchmarkPickFilter(b *testing.B) {
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := strings.Split(strings.Repeat(string(data)+"\n", 1000), "\n")
+
+	specs := []string{"re:[A-Z]+:"}
+	for c := 'a'; c <= 'z'; c++ {
+		specs = append(specs, "re:"+string(c)+"[0-9]")
+	}
+
+	for _, zeroWins := range []bool{false, true} {
+		cfg := Config{TieBreak: "longest", PriorityZeroWins: zeroWins}
+		var filters []filter
+		for _, spec := range specs {
+			f, err := compileFilter(spec, &cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			filters = append(filters, f)
+		}
+		b.Run(fmt.Sprintf("zero-wins=%v", zeroWins), func(b *testing.B) {
+			for b.Loop() {
+				for _, line := range lines {
+					pickFilter(filters, line, &cfg)
+				}
+			}
+		})
+	}
+}
+
+func TestFlushEvents(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a\\nWARN b\\nWARN c\\nx\\nINFO d\\n' | ./%s -f 'ERROR,WARN,INFO' --flush-events --limit 2 2>&1 >/dev/null", binName)
+	expected := `
+{"flush":1,"lines":2,"bands":[{"band":1,"lines":2}],"reason":"limit"}
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestIdleFlush(t *testing.T) {
+	// Lines keep arriving faster than the timeout, so nothing flushes
+	// before EOF and everything comes out sorted
+	cmd := fmt.Sprintf("(printf 'd\\n'; sleep 0.2; printf 'c\\n'; sleep 0.2; printf 'b\\n'; sleep 0.2; printf 'a\\n') | ./%s --timeout 400ms --idle-flush", binName)
+	expected := `
+a
+b
+c
+d
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestPinFilter(t *testing.T) {
+	cmd := fmt.Sprintf("(printf 'b\\nALERT disk\\na\\n'; sleep 0.5; printf 'c\\nALERT disk\\n') | ./%s -f 'x,pin:ALERT' --timeout 300ms --flush-marker '--'", binName)
+	expected := `
+ALERT disk
+a
+b
+--
+ALERT disk
+c
+--
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestRate(t *testing.T) {
+	// The top band is printed first and takes the whole budget
+	cmd := fmt.Sprintf("seq 1 50 | ./%s -f '7' --rate 5", binName)
+	expected := `
+7
+17
+27
+37
+47
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("seq 1 7 | ./%s --rate 5 --rate-overflow buffer", binName)
+	CheckNumberOfLines(t, runPipeline(t, cmd), 7)
+}
+
+func TestTransformCmd(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b hello\\na world\\nc ERROR\\n' | ./%s --transform-cmd \"sed -u 's/hello/ERROR/'\" -f 'ERROR' -o", binName)
+	expected := `
+b hello
+c ERROR
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	// The command quits after one line; the rest pass through untransformed
+	cmd = fmt.Sprintf("printf 'x\\ny\\nz\\n' | ./%s --transform-cmd 'head -n 1' 2>&1", binName)
+	CheckContains(t, runPipeline(t, cmd), "matching untransformed lines")
+}
+
+func TestMaxBands(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'd\\nc\\nb\\na\\nx\\n' | ./%s -f 'zz,a,b,d,c' --max-bands 2 --show-key 2>/dev/null", binName)
+	expected := "1:a\ta\n2:b\tb\n3:c\tc\n3:d\td\n999999:x\tx"
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestKeyValueFilters(t *testing.T) {
+	file := "kv_filters_test.txt"
+	defer os.Remove(file)
+	os.WriteFile(file, []byte("pattern=1:warn priority=5 word=true\npattern=\"ERROR:\" priority=0\npattern=^pl mode=re priority=1\n"), 0644)
+
+	// 1:warn is a plain literal here, not a field filter
+	cmd := fmt.Sprintf("printf 'plain\\nERROR: disk\\nuser:1:warn x\\nWARN foo\\nuser:1:warning\\n' | ./%s %s", binName, file)
+	expected := `
+ERROR: disk
+plain
+user:1:warn x
+WARN foo
+user:1:warning
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestPrefix(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\n[x] a\\n' | ./%s -f '[x]' --prefix '[x] '", binName)
+	expected := `
+[x] [x] a
+[x] b
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("printf 'a\\n' | ./%s --prefix '> ' --prefix-color 36", binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[36m> \x1b[0ma")
+}
+
+func TestPriorityArgs(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'info a\\nWARN b\\nuser@host c\\nERROR d\\nx\\n' | ./%s -i -- INFO@2 WARN@1 ERROR@0 user@host", binName)
+	expected := `
+ERROR d
+WARN b
+info a
+user@host c
+x
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	// A "--" that is a flag's value doesn't end the flags
+	cmd = fmt.Sprintf("printf 'ERROR\\n' > dash.filters; printf 'a\\nERROR x\\n' | ./%s --flush-marker -- dash.filters; rm -f dash.filters", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR x\na\n--")
+
+	cmd = fmt.Sprintf("printf 'a\\nERROR x\\n' | ./%s --flush-marker -- -- ERROR@0", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR x\na\n--")
+}
+
+func TestSqueeze(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\nERROR x\\nb\\nerror x\\nB\\na\\n' | ./%s -f ERROR -i --squeeze", binName)
+	expected := `
+ERROR x
+a
+b
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestHeartbeat(t *testing.T) {
+	cmd := fmt.Sprintf("(printf 'a\\n'; sleep 0.5; printf 'b\\n') | ./%s -k --heartbeat 200ms --heartbeat-text 'alive' 2>&1 >/dev/null", binName)
+	got := runPipeline(t, cmd)
+	CheckPrefix(t, got, "alive")
+	if n := strings.Count(got, "alive"); n < 1 || n > 2 {
+		t.Errorf("expected 1-2 heartbeats, got %d: %q", n, got)
+	}
+}
+
+func TestPriorityWins(t *testing.T) {
+	// Longest match sends the INFO_PAD line below DEBUG, as in
+	// TestMatchLengthOrdering; with --priority-wins INFO claims it
+	cmd := fmt.Sprintf("grep '.' %s | ./%s -f 'INFO,DEBUG,INFO_PAD' -o", testFile, binName)
+	expected := `
+INFO: starting service
+INFO: errorneous data found
+DEBUG: connection established
+DEBUG: payload received
+WARN: INFO_PAD not found
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("grep '.' %s | ./%s -f 'INFO,DEBUG,INFO_PAD' -o --priority-wins", testFile, binName)
+	expected = `
+INFO: starting service
+INFO: errorneous data found
+WARN: INFO_PAD not found
+DEBUG: connection established
+DEBUG: payload received
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("./%s --priority-wins --tie-break lastlisted < /dev/null 2>&1 || true", binName)
+	CheckContains(t, runPipeline(t, cmd), "conflicts")
+
+	cmd = fmt.Sprintf("./%s --priority-wins --tie-break longest < /dev/null 2>&1 || true", binName)
+	CheckString(t, runPipeline(t, cmd), "--priority-wins conflicts with --tie-break longest")
+}
+
+func TestOutputRing(t *testing.T) {
+	file := "ring_test.txt"
+	defer os.Remove(file)
+	cmd := fmt.Sprintf("printf 'c\\nERROR a\\nb\\nd\\n' | ./%s -f ERROR --output-ring %s --ring-size 3", binName, file)
+	expected := `
+ERROR a
+b
+c
+d
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	content, _ := os.ReadFile(file)
+	CheckString(t, strings.TrimSpace(string(content)), "b\nc\nd")
+}
+
+func TestStrictFileArgs(t *testing.T) {
+	file := "strict_args_test.txt"
+	defer os.Remove(file)
+	os.WriteFile(file, []byte("# dash filters\n[options]\n-o\n[filters]\n--verbose\n- item\n"), 0644)
+
+	cmd := fmt.Sprintf("printf 'x\\n- item b\\nrun --verbose\\n' | ./%s --strict-file-args %s", binName, file)
+	expected := `
+run --verbose
+- item b
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	os.WriteFile(file, []byte("-o\nERROR\n"), 0644)
+	cmd = fmt.Sprintf("./%s --strict-file-args %s < /dev/null 2>&1 || true", binName, file)
+	CheckContains(t, runPipeline(t, cmd), "outside the [options] and [filters] sections")
+}
+
+func TestFileArgs(t *testing.T) {
+	file := "file_args_test.txt"
+	defer os.Remove(file)
+	os.WriteFile(file, []byte("-k --exec-env X=1,2\nERROR\n"), 0644)
+
+	cmd := fmt.Sprintf("printf 'a\\nERROR\\n' | ./%s %s", binName, file)
+	CheckString(t, runPipeline(t, cmd), "a\nERROR")
+
+	// The command line wins, under an alias too
+	cmd = fmt.Sprintf("printf 'a\\nERROR\\n' | ./%s --keep-going=false %s", binName, file)
+	CheckString(t, runPipeline(t, cmd), "ERROR\na")
+
+	// Repeatable flags keep each value whole
+	cmd = fmt.Sprintf("./%s -e 'printenv X' %s", binName, file)
+	CheckString(t, runPipeline(t, cmd), "1,2")
+}
+
+func TestByMatchCount(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'db\\nERROR db\\nnone\\ntimeout db\\nERROR timeout db\\nERROR\\n' | ./%s -f 'ERROR,timeout,db' --by-match-count -o", binName)
+	expected := `
+ERROR timeout db
+ERROR db
+timeout db
+ERROR
+db
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestBinarySafe(t *testing.T) {
+	// Without --binary-safe both invalid bytes fold to U+FFFD under -i and
+	// x\376 matches the x\377 filter
+	cmd := fmt.Sprintf("printf 'x\\376\\r\\nERROR \\377\\r\\n' | ./%s -f \"$(printf 'x\\377')\" -i --binary-safe | tr '\\r\\376\\377' 'RAB'", binName)
+	expected := `
+ERROR BR
+xAR
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestInitialDelay(t *testing.T) {
+	cmd := fmt.Sprintf("(printf 'b\\n'; sleep 0.4; printf 'a\\n'; sleep 0.4) | ./%s --timeout 200ms", binName)
+	CheckString(t, runPipeline(t, cmd), "b\na")
+
+	cmd = fmt.Sprintf("(printf 'b\\n'; sleep 0.4; printf 'a\\n'; sleep 0.4) | ./%s --timeout 200ms --initial-delay 2s", binName)
+	CheckString(t, runPipeline(t, cmd), "a\nb")
+}
+
+func TestJSONSortField(t *testing.T) {
+	input := `{"msg":"ERROR a","req":{"ms":30}}\n{"msg":"ok","req":{"ms":"slow"}}\n{"msg":"ERROR b","req":{"ms":5}}\nplain\n{"msg":"ok","req":{"ms":12}}\n`
+	cmd := fmt.Sprintf("printf '%s' | ./%s -f FATAL,ERROR --json-sort-field req.ms --timeout 0", input, binName)
+	expected := `
+{"msg":"ERROR b","req":{"ms":5}}
+{"msg":"ERROR a","req":{"ms":30}}
+{"msg":"ok","req":{"ms":12}}
+plain
+{"msg":"ok","req":{"ms":"slow"}}
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestMatchSortCase(t *testing.T) {
+	// "a error" only matches when matching folds; "b ERROR" and "B ERROR"
+	// only tie (keeping input order) when sorting folds
+	tests := []struct {
+		flags    string
+		expected string
+	}{
+		{"", "\nB ERROR\nb ERROR\nA x\na error\n"},
+		{"--match-case fold", "\nB ERROR\na error\nb ERROR\nA x\n"},
+		{"--sort-case fold", "\nb ERROR\nB ERROR\na error\nA x\n"},
+		{"--match-case fold --sort-case fold", "\na error\nb ERROR\nB ERROR\nA x\n"},
+		{"-i", "\na error\nb ERROR\nB ERROR\nA x\n"},
+		{"-i --match-case preserve", "\nb ERROR\nB ERROR\na error\nA x\n"},
+		{"-i --sort-case preserve", "\nB ERROR\na error\nb ERROR\nA x\n"},
+	}
+	for _, tt := range tests {
+		cmd := fmt.Sprintf("printf 'b ERROR\\na error\\nB ERROR\\nA x\\n' | ./%s -f 'zz,ERROR' %s", binName, tt.flags)
+		got := runPipeline(t, cmd)
+		CheckString(t, got, tt.expected)
+	}
+
+	// -w boundaries are the same either way
+	cmd := fmt.Sprintf("printf 'xERROR\\nerror x\\n' | ./%s -f ERROR -w --match-case fold -o", binName)
+	CheckString(t, runPipeline(t, cmd), "error x")
+}
+
+func TestFlushSeparator(t *testing.T) {
+	cmd := fmt.Sprintf("(printf 'b\\na\\n'; sleep 0.4; printf 'd\\nc\\n') | ./%s --timeout 200ms --flush-separator '---'", binName)
+	expected := `
+a
+b
+---
+c
+d
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestBrief(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a\\nERROR\\nb\\nWARN\\n' | ./%s -f ERROR,WARN --brief 2>&1 >/dev/null", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "ssort: 4 lines, 2 matched (50%), 1 flushes, ")
+
+	cmd = fmt.Sprintf("printf 'a\\n' | ./%s --brief --quiet-errors 2>&1", binName)
+	CheckString(t, runPipeline(t, cmd), "a")
+}
+
+func TestInterleave(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'c\\nWARN b\\na\\nERROR d\\n' | ./%s -f ERROR,WARN --interleave", binName)
+	expected := `
+ERROR d
+c
+WARN b
+a
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestPrior(t *testing.T) {
+	file := "prior_test.txt"
+	defer os.Remove(file)
+	os.WriteFile(file, []byte("WARN c\nx\nWARN c\nWARN b\ny\n"), 0644)
+
+	input := "printf 'WARN a\\nWARN b\\nWARN c\\nERROR z\\nx\\ny\\n'"
+	cmd := fmt.Sprintf("%s | ./%s -f FATAL,ERROR,WARN --prior %s", input, binName, file)
+	expected := `
+ERROR z
+WARN c
+WARN b
+WARN a
+x
+y
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("%s | ./%s -f FATAL,ERROR,WARN --prior %s --prior-weight 2", input, binName, file)
+	expected = `
+WARN c
+ERROR z
+WARN b
+WARN a
+x
+y
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestWarnUnused(t *testing.T) {
+	// INFO never wins a line but does match one, so only FATAL is unused
+	cmd := fmt.Sprintf("printf 'ERROR INFO\\nx\\n' | ./%s -f FATAL,ERROR,INFO --tie-break firstlisted --warn-unused 2>&1 >/dev/null", binName)
+	CheckString(t, runPipeline(t, cmd), "Unused filter 'FATAL' (priority 0): no line matched it")
+}
+
+func TestStdinFlag(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\n' | ./%s -e 'echo a'", binName)
+	CheckString(t, runPipeline(t, cmd), "a")
+
+	cmd = fmt.Sprintf("printf 'b\\nERROR c\\n' | ./%s -e 'echo a' --stdin -f ERROR", binName)
+	expected := `
+ERROR c
+a
+b
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestStreamMatches(t *testing.T) {
+	// WARN is printed while the input is still open
+	cmd := fmt.Sprintf("(printf 'x\\nWARN a\\n'; sleep 1; printf 'ERROR b\\n') | ./%s -f ERROR,WARN --stream-matches --timeout 5s | head -1", binName)
+	CheckString(t, runPipeline(t, cmd), "WARN a")
+
+	cmd = fmt.Sprintf("printf 'x\\nWARN a\\nERROR b\\n' | ./%s -f ERROR,WARN --stream-matches", binName)
+	CheckString(t, runPipeline(t, cmd), "WARN a\nERROR b")
+}
+
+func TestLimitBytes(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'ccc\\naaa\\nbbb\\n' | ./%s --limit-bytes 10 | wc -c", binName)
+	CheckString(t, runPipeline(t, cmd), "8")
+
+	cmd = fmt.Sprintf("printf 'ccc\\naaa\\nbbb\\n' | ./%s --limit-bytes 10 --byte-cut exact", binName)
+	CheckString(t, runPipeline(t, cmd), "aaa\nbbb\ncc")
+
+	cmd = fmt.Sprintf("printf 'a\\n' | ./%s --limit-bytes 1K --byte-cut exact", binName)
+	CheckString(t, runPipeline(t, cmd), "a")
+}
+
+func TestWordUnicode(t *testing.T) {
+	// Han characters are words of their own, Katakana runs aren't split
+	input := "printf '東京都に住む\\n東京 tower\\nテストケース\\nテスト 1\\n'"
+	cmd := fmt.Sprintf("%s | ./%s -o -w --word-boundary-mode unicode -f '東京,テスト'", input, binName)
+	CheckString(t, runPipeline(t, cmd), "東京 tower\nテスト 1")
+
+	cmd = fmt.Sprintf("%s | ./%s -o --word-unicode -f '東京,テスト'", input, binName)
+	expected := `
+東京都に住む
+東京 tower
+テスト 1
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	// Accents: precomposed é is a letter, a decomposed one keeps its mark
+	input = "printf 'café bar\\ncaféine\\ncafe\\314\\201 noir\\n'"
+	cmd = fmt.Sprintf("%s | ./%s -o --word-unicode -f 'café,cafe'", input, binName)
+	CheckString(t, runPipeline(t, cmd), "café bar")
+}
+
+func TestStateFile(t *testing.T) {
+	file := "state_test.json"
+	defer os.Remove(file)
+
+	cmd := fmt.Sprintf("printf 'ALERT one\\nz\\n' | ./%s -f 'pin:ALERT,ERROR' --pin-ttl 0 --state-file %s", binName, file)
+	CheckString(t, runPipeline(t, cmd), "ALERT one\nALERT one\nz")
+
+	// The pin survives the restart, and lines seen before sort first
+	cmd = fmt.Sprintf("printf 'y\\nz\\nERROR b\\n' | ./%s -f 'pin:ALERT,ERROR' --pin-ttl 0 --state-file %s", binName, file)
+	expected := `
+ALERT one
+ERROR b
+z
+y
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	os.WriteFile(file, []byte(`{"version":99}`), 0644)
+	cmd = fmt.Sprintf("printf 'a\\n' | ./%s --state-file %s 2>&1", binName, file)
+	CheckString(t, runPipeline(t, cmd), "Ignoring --state-file: unsupported version 99\na")
+}
+
+func TestGroupBy(t *testing.T) {
+	input := "printf 'req=b 2\\nnoise\\nreq=a 1\\nreq=b 1\\nreq=c 1\\nreq=a 2\\nreq=a ERROR\\n'"
+	cmd := fmt.Sprintf("%s | ./%s -f zz,ERROR --group-by 'req=(\\w+)'", input, binName)
+	expected := `
+req=b 1
+req=b 2
+req=a ERROR
+req=a 1
+req=a 2
+req=c 1
+noise
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("printf 'k2\\nk1\\nk1\\nk3\\n' | ./%s --group-by 'k\\d' --group-order size", binName)
+	CheckString(t, runPipeline(t, cmd), "k1\nk1\nk2\nk3")
+
+	cmd = fmt.Sprintf("printf 'x\\n' | ./%s --group-by x --group-order nope 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --group-order")
+}
+
+func TestCollapseUnmatched(t *testing.T) {
+	input := "printf 'a\\nERROR 1\\nb\\nc\\nERROR 2\\nd\\n'"
+	cmd := fmt.Sprintf("%s | ./%s -f zz,ERROR --collapse-unmatched", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR 1\nERROR 2\n... 4 unmatched lines ...")
+
+	cmd = fmt.Sprintf("%s | ./%s -f zz,ERROR --interleave --collapse-unmatched --collapse-text '[{count} hidden]'", input, binName)
+	expected := `
+[1 hidden]
+ERROR 1
+[2 hidden]
+ERROR 2
+[1 hidden]
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestWaitFor(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a\\nERROR x\\nSTART\\nc\\nERROR\\n' | ./%s -f zz,ERROR --wait-for START", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR\nSTART\nc")
+
+	cmd = fmt.Sprintf("printf 'a\\nERROR x\\nSTART\\nc\\nERROR\\n' | ./%s -f zz,ERROR --wait-for START --wait-backlog", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR\nERROR x\nSTART\na\nc")
+
+	cmd = fmt.Sprintf("printf 'a\\nb\\n' | ./%s --wait-for START", binName)
+	CheckString(t, runPipeline(t, cmd), "")
+}
+
+func TestContextChars(t *testing.T) {
+	input := `printf '{"a":1,"b":"xxERRORyy","c":3}\nshort ERROR\nnone\n'`
+	cmd := fmt.Sprintf("%s | ./%s -f ERROR --context-chars 4", input, binName)
+	expected := `
+…:"xxERRORyy",…
+…ort ERROR
+none
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("%s | ./%s -f ERROR --context-chars 1 --highlight", input, binName)
+	CheckPrefix(t, runPipeline(t, cmd), "…x\x1b[1;31mERROR\x1b[0my…")
+}
+
+func TestSortNumericField(t *testing.T) {
+	input := "printf 'a,10\\nb,9\\nERROR,3\\nc,x\\nd\\nERROR,1\\ne,1.5\\n'"
+	cmd := fmt.Sprintf("%s | ./%s -d , -f zz,ERROR --sort-numeric-field 2", input, binName)
+	expected := `
+ERROR,1
+ERROR,3
+e,1.5
+b,9
+a,10
+c,x
+d
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("./%s --sort-numeric-field 2 --json-sort-field a < /dev/null 2>&1 || true", binName)
+	CheckString(t, runPipeline(t, cmd), "--sort-numeric-field conflicts with --json-sort-field")
+}
+
+func TestExprFilter(t *testing.T) {
+	input := "printf 'ERROR in test\\nx\\nERROR, prod\\nWARN x\\nstart WARN\\n'"
+	cmd := fmt.Sprintf(`%s | ./%s -f 'zz,expr:contains("ERROR,") and not contains("test"),expr:startswith("warn") or (endswith("WARN") and not startswith("x"))' -i`, input, binName)
+	expected := `
+ERROR, prod
+start WARN
+WARN x
+ERROR in test
+x
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf(`./%s -f 'expr:contains("x") and' < /dev/null 2>&1 || true`, binName)
+	CheckString(t, runPipeline(t, cmd), `Invalid filter pattern 'expr:contains("x") and': column 18: unexpected end of expression`)
+}
+
+func TestRecolor(t *testing.T) {
+	cmd := fmt.Sprintf("printf '\\033[32mgreen ERROR\\033[0m\\nplain\\n' | ./%s -f ERROR --color --recolor 33", binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[33mgreen ERROR\x1b[0m\n\x1b[33mplain\x1b[0m")
+
+	cmd = fmt.Sprintf("printf 'an ERROR here\\n' | ./%s -f ERROR --recolor 33 --highlight", binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[33man \x1b[1;31mERROR\x1b[0m\x1b[33m here\x1b[0m")
+}
+
+func TestJoin(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'a1\\na2\\nERROR b1\\nb2\\nc1\\n' | ./%s -f zz,ERROR --join 2", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR b1 b2\na1 a2\nc1")
+
+	cmd = fmt.Sprintf("printf 'start ok\\n  at x\\nfail ERROR\\n  at y\\n  at z\\n' | ./%s -f zz,ERROR --join-delimiter '^\\S' --flatten=false", binName)
+	expected := `
+fail ERROR
+  at y
+  at z
+start ok
+  at x
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestFlatten(t *testing.T) {
+	input := "printf 'start ok\\n  at x\\nfail ERROR\\n  at y\\nnext ERROR\\n'"
+	cmd := fmt.Sprintf("%s | ./%s -f zz,ERROR --join-delimiter '^\\S' --flatten=false --limit 1 --prefix '> '", input, binName)
+	CheckString(t, runPipeline(t, cmd), "> fail ERROR\n>   at y")
+
+	cmd = fmt.Sprintf("%s | ./%s -f zz,ERROR --join-delimiter '^\\S' --flatten=false --count-lines", input, binName)
+	CheckString(t, runPipeline(t, cmd), "3")
+}
+
+func TestTimeoutEnv(t *testing.T) {
+	input := "(printf 'b\\n'; sleep 0.4; printf 'a\\n')"
+	cmd := fmt.Sprintf("%s | SSORT_TIMEOUT=100ms ./%s", input, binName)
+	CheckString(t, runPipeline(t, cmd), "b\na")
+
+	// The flag still wins
+	cmd = fmt.Sprintf("%s | SSORT_TIMEOUT=100ms ./%s --timeout 1s", input, binName)
+	CheckString(t, runPipeline(t, cmd), "a\nb")
+
+	cmd = fmt.Sprintf("%s | SSORT_TIMEOUT=bad ./%s 2>&1", input, binName)
+	CheckString(t, runPipeline(t, cmd), "Ignoring SSORT_TIMEOUT 'bad': time: invalid duration \"bad\"\na\nb")
+}
+
+func TestTeeStderr(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\nERROR a\\n' | ./%s -f zz,ERROR --tee-stderr --prefix '> ' 2>&1 >/dev/null", binName)
+	CheckString(t, runPipeline(t, cmd), "> ERROR a\n> b")
+
+	cmd = fmt.Sprintf("printf 'b\\nERROR a\\n' | ./%s -f zz,ERROR --tee-stderr 2>/dev/null", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR a\nb")
+}
+
+func TestWhenBlocks(t *testing.T) {
+	file := "when_test.txt"
+	content := `-o
+zz
+[when contains("GET") or contains("POST")]
+re: 5\d\d
+[end]
+timeout
+`
+	os.WriteFile(file, []byte(content), 0644)
+	defer os.Remove(file)
+
+	cmd := fmt.Sprintf("printf 'GET /a 502\\nbatch 500 items\\nPOST timeout\\njob 503 timeout\\n' | ./%s %s", binName, file)
+	CheckString(t, runPipeline(t, cmd), "GET /a 502\nPOST timeout\njob 503 timeout")
+
+	os.WriteFile(file, []byte("[when contains(x)]\nERROR\n"), 0644)
+	cmd = fmt.Sprintf("./%s %s < /dev/null 2>&1 || true", binName, file)
+	CheckString(t, runPipeline(t, cmd), "Invalid guard '[when contains(x)]': column 10: expected a string")
+}
+
+func TestFormat(t *testing.T) {
+	cmd := fmt.Sprintf(`printf 'b\nERROR a\nWARN c\n' | ./%s -f ERROR,WARN --format '{{.LineNo}} [{{.Priority}}] {{if .Matched}}{{.Filter}}{{else}}-{{end}}: {{.Line}}'`, binName)
+	expected := `
+2 [0] ERROR: ERROR a
+3 [1] WARN: WARN c
+1 [999999] -: b
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf(`printf 'a\nb\n' | ./%s --format '{{.Line.Nope}}' 2>&1`, binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Error running --format template")
+	CheckNumberOfLines(t, runPipeline(t, cmd), 3)
+}
+
+func TestTrip(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\nWARN a\\nFATAL x\\nafter\\n' | ./%s -f zz,WARN --trip FATAL --trip-code 7; echo \"status $?\"", binName)
+	CheckString(t, runPipeline(t, cmd), "WARN a\nb\nFATAL x\nstatus 7")
+
+	cmd = fmt.Sprintf("printf 'FATAL\\n' | ./%s --trip FATAL --always-exit-zero; echo \"status $?\"", binName)
+	CheckString(t, runPipeline(t, cmd), "FATAL\nstatus 0")
+}
+
+func TestDedupeByFingerprint(t *testing.T) {
+	input := "printf 'user 1 failed\\nok 5\\nuser 22 failed\\nuser 3 failed\\nok 6\\nnew\\n'"
+	cmd := fmt.Sprintf("%s | ./%s --fingerprint '[0-9]+' --dedupe-by-fingerprint", input, binName)
+	CheckString(t, runPipeline(t, cmd), "3\tuser 1 failed\n2\tok 5\n1\tnew")
+
+	cmd = fmt.Sprintf("%s | ./%s --fingerprint '[0-9]+' --dedupe-by-fingerprint --fingerprint-sample last --min-freq 2", input, binName)
+	CheckString(t, runPipeline(t, cmd), "3\tuser 3 failed\n2\tok 6")
+}
+
+func TestMaxMemory(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\na\\nd\\nc\\n' | ./%s --max-memory 4", binName)
+	CheckString(t, runPipeline(t, cmd), "a\nb\nd\nc")
+
+	// Unmatched lines go first, then the newest of the lowest band
+	cmd = fmt.Sprintf("printf 'b1\\nWARN x\\nb2\\nb3\\nWARN y\\n' | ./%s -f zz,WARN --max-memory 20 --memory-policy evict 2>&1", binName)
+	CheckString(t, runPipeline(t, cmd), "Buffer over --max-memory, dropping lowest-priority lines\nWARN x")
+}
+
+func TestLimitWithTopPriority(t *testing.T) {
+	// Top-priority lines printed straight away count toward --limit, and the
+	// buffered match completing it flushes at once, not at EOF
+	input := "printf 'WARN a\\nERROR 1\\nWARN b\\nERROR 2\\n'"
+	cmd := fmt.Sprintf("%s | ./%s -f ERROR,WARN --limit 2", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR 1\nWARN a")
+	cmd = fmt.Sprintf("%s | ./%s -f ERROR,WARN --limit 2 --flush-events 2>&1 >/dev/null", input, binName)
+	CheckString(t, runPipeline(t, cmd), `{"flush":1,"lines":1,"bands":[{"band":1,"lines":1}],"reason":"limit"}`)
+
+	cmd = fmt.Sprintf("%s | ./%s -f ERROR,WARN --limit 3", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR 1\nWARN a\nWARN b")
+
+	// The count carries across flushes: one line left after the first
+	input = "(printf 'ERROR 1\\nWARN a\\n'; sleep 0.3; printf 'WARN c\\nWARN b\\n')"
+	cmd = fmt.Sprintf("%s | ./%s -f ERROR,WARN --limit 3 --timeout 100ms", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR 1\nWARN a\nWARN c")
+	cmd = fmt.Sprintf("%s | ./%s -f ERROR,WARN --limit 3 --timeout 100ms --flush-events 2>&1 >/dev/null", input, binName)
+	expected := `
+{"flush":1,"lines":1,"bands":[{"band":1,"lines":1}],"reason":"timeout"}
+{"flush":2,"lines":1,"bands":[{"band":1,"lines":1}],"reason":"limit"}
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	// Lines --squeeze drops don't count
+	cmd = fmt.Sprintf("printf 'WARN a\\nWARN a\\nWARN a\\nWARN b\\nWARN c\\n' | ./%s -f ERROR,WARN --limit 3 --squeeze", binName)
+	CheckString(t, runPipeline(t, cmd), "WARN a\nWARN b\nWARN c")
+
+	// Neither do lines -k passes through
+	cmd = fmt.Sprintf("printf 'x1\\nx2\\nx3\\nERROR a\\nWARN b\\n' | ./%s -f ERROR,WARN --limit 2 -k", binName)
+	CheckString(t, runPipeline(t, cmd), "x1\nx2\nx3\nERROR a\nWARN b")
+}
+
+func TestPassthroughFlag(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\r\\na\\nno newline' | ./%s --passthrough -i | od -c", binName)
+	CheckString(t, runPipeline(t, cmd), runPipeline(t, "printf 'b\\r\\na\\nno newline' | od -c"))
+
+	cmd = fmt.Sprintf("printf 'b\\na\\n' | ./%s --passthrough --prefix '> '", binName)
+	CheckString(t, runPipeline(t, cmd), "> b\n> a")
+
+	// With filters ssort sorts as usual
+	cmd = fmt.Sprintf("printf 'b\\na\\n' | ./%s --passthrough -f zz", binName)
+	CheckString(t, runPipeline(t, cmd), "a\nb")
+}
+
+func TestReverseInput(t *testing.T) {
+	cmd := fmt.Sprintf("printf '1\\nERROR 2\\n3\\nERROR 4\\n' | ./%s --reverse-input -f ERROR --no-sort", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR 4\n3\nERROR 2\n1")
+
+	cmd = fmt.Sprintf("printf 'a1\\n  a2\\nb1\\n  b2\\n' | ./%s --reverse-input --join-delimiter '^\\S' --flatten=false --passthrough", binName)
+	CheckString(t, runPipeline(t, cmd), "b1\n  b2\na1\n  a2")
+}
+
+func TestByteOffsets(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'aa\\nbb ERROR\\ncc\\ndd ERROR\\n' > offsets.txt && ./%s --byte-offsets -f ERROR < offsets.txt; rm -f offsets.txt", binName)
+	CheckString(t, runPipeline(t, cmd), "3:bb ERROR\n15:dd ERROR\n0:aa\n12:cc")
+
+	cmd = fmt.Sprintf("printf 'aa\\nbb ERROR\\n' | ./%s --byte-offsets -f ERROR 2>&1", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Ignoring --byte-offsets")
+}
+
+func TestFilterTimeout(t *testing.T) {
+	cmd := fmt.Sprintf("seq 1 5 | ./%s --filter-timeout 1s -f 3", binName)
+	CheckString(t, runPipeline(t, cmd), "3\n1\n2\n4\n5")
+
+	// Timed out lines fall back to unmatched, none are lost
+	cmd = fmt.Sprintf("seq 1 5 | ./%s --filter-timeout 1ns -f 3 2>/dev/null", binName)
+	CheckNumberOfLines(t, runPipeline(t, cmd), 5)
+
+	// Two stuck workers at most: the third slow line isn't tried, and the
+	// warning for that comes once
+	cmd = fmt.Sprintf("(for i in 1 2 3 4; do head -c 3000000 /dev/zero | tr '\\0' a; echo; done) | ./%s --filter-timeout 1ms -f 're:(a|b)*c' 2>&1 >/dev/null | cut -c1-39", binName)
+	expected := `
+Line 1: filters took over 1ms, treating
+Line 2: filters took over 1ms, treating
+Filter workers stuck past --filter-time
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+
+	cmd = fmt.Sprintf("seq 1 5 | ./%s --filter-timeout -1s -f 3 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --filter-timeout")
+}
+
+func TestHeaderFields(t *testing.T) {
+	csv := `printf 'ts,status,ms\n1,200,30\n2,500,5\n3,404,100\n4,503,7\n'`
+	cmd := fmt.Sprintf("%s | ./%s --header-fields -d , -f 'status:re:^5' --sort-numeric-field ms", csv, binName)
+	CheckString(t, runPipeline(t, cmd), "ts,status,ms\n2,500,5\n4,503,7\n1,200,30\n3,404,100")
+
+	cmd = fmt.Sprintf("%s | ./%s --header-fields -d , -f 'status:re:^4 && ms:100'", csv, binName)
+	CheckString(t, runPipeline(t, cmd), "ts,status,ms\n3,404,100\n1,200,30\n2,500,5\n4,503,7")
+
+	cmd = fmt.Sprintf("%s | ./%s --header-fields -d , -f 'code:5' 2>&1 || true", csv, binName)
+	CheckPrefix(t, runPipeline(t, cmd), "--header-fields: no field 'code'")
+
+	cmd = fmt.Sprintf("%s | ./%s -d , --sort-numeric-field ms 2>&1 || true", csv, binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --sort-numeric-field 'ms'")
+}
+
+func TestMatchReport(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'db ERROR x\\nERROR y\\nz\\ndb\\n' | ./%s --match-report -f ERROR,db", binName)
+	CheckString(t, runPipeline(t, cmd), "db ERROR x {ERROR,db}\nERROR y {ERROR}\ndb {db}\nz")
+}
+
+func TestFlushReverse(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\nWARN x\\na\\nINFO y\\n' | ./%s --flush-reverse -f ERROR,WARN,INFO", binName)
+	CheckString(t, runPipeline(t, cmd), "b\na\nINFO y\nWARN x")
+
+	cmd = fmt.Sprintf("printf 'b\\nWARN x\\na\\nINFO y\\n' | ./%s --flush-reverse --limit 2 -f ERROR,WARN,INFO", binName)
+	CheckString(t, runPipeline(t, cmd), "INFO y\nWARN x")
+}
+
+func TestBufferSource(t *testing.T) {
+	cmd := fmt.Sprintf(`printf 'zz\nERROR in\nWARN in\naa\n' | ./%s --stdin -e "printf 'b\nWARN ex\na\n'" --buffer-source exec -f ERROR,WARN`, binName)
+	CheckString(t, runPipeline(t, cmd), "zz\nERROR in\nWARN in\naa\nWARN ex\na\nb")
+
+	cmd = fmt.Sprintf("echo a | ./%s --buffer-source both 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --buffer-source 'both'")
+}
+
+func TestDryMatch(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'b\\nWARN x\\nERROR y\\na\\n' | ./%s --dry-match -f ERROR,WARN", binName)
+	CheckString(t, runPipeline(t, cmd), "b [unmatched]\nWARN x [priority=1 filter=WARN]\nERROR y [priority=0 filter=ERROR]\na [unmatched]")
+}
+
+func TestColorTest(t *testing.T) {
+	cmd := fmt.Sprintf("./%s --color-test | head -1", binName)
+	CheckString(t, runPipeline(t, cmd), "--highlight            db: \x1b[1;31mERROR\x1b[0m connection refused")
+}
+
+func TestDemotePromote(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'WARN test x\\nWARN y\\nERROR test\\nINFO a\\nINFO urgent\\n' | ./%s -f ERROR,WARN,INFO --demote test --promote urgent@2", binName)
+	CheckString(t, runPipeline(t, cmd), "INFO urgent\nERROR test\nWARN y\nINFO a\nWARN test x")
+
+	cmd = fmt.Sprintf("echo a | ./%s -f a --demote a@0 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --demote shift in 'a@0'")
+
+	// Demoting past the last filter band stops there
+	cmd = fmt.Sprintf("printf 'a x\\nb\\n' | ./%s -f a,b --demote x@5 --dry-match", binName)
+	CheckString(t, runPipeline(t, cmd), "a x [priority=1 filter=a]\nb [priority=1 filter=b]")
+}
+
+func TestInputEncoding(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'na\\357ve\\ncaf\\351 ERROR\\n' | ./%s --input-encoding latin1 -f é", binName)
+	CheckString(t, runPipeline(t, cmd), "café ERROR\nnaïve")
+
+	cmd = fmt.Sprintf("printf 'caf\\303\\251\\n' | ./%s --output-encoding ISO-8859-1 -f caf | od -An -c | tr -s ' '", binName)
+	CheckString(t, runPipeline(t, cmd), " c a f 351 \\n")
+
+	cmd = fmt.Sprintf("echo a | ./%s --input-encoding klingon 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --input-encoding 'klingon': unknown charset")
+}
+
+func TestBandOrderInput(t *testing.T) {
+	input := `printf 'WARN c\na\nERROR b\nWARN a\nz\nWARN b\n'`
+	cmd := fmt.Sprintf("%s | ./%s --band-order input -f ERROR,WARN", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR b\nWARN c\nWARN a\nWARN b\na\nz")
+
+	// --unmatched-sort still orders the unmatched band when set
+	cmd = fmt.Sprintf("%s | ./%s --band-order input --unmatched-sort reverse -f ERROR,WARN", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR b\nWARN c\nWARN a\nWARN b\nz\na")
+
+	cmd = fmt.Sprintf("%s | ./%s --band-order content -f ERROR,WARN", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR b\nWARN a\nWARN b\nWARN c\na\nz")
+
+	cmd = fmt.Sprintf("%s | ./%s --band-order input --sort-numeric-field 2 2>&1 || true", input, binName)
+	CheckPrefix(t, runPipeline(t, cmd), "--band-order input conflicts with --sort-numeric-field")
+}
+
+func TestControlFd(t *testing.T) {
+	input := `(printf 'ERROR 1\n'; sleep 0.5; printf 'INFO 2\nERROR 2\n')`
+	control := `(sleep 0.2; echo '@filters INFO')`
+	cmd := fmt.Sprintf("%s | { %s | ./%s --control-fd 3 -f ERROR --deterministic; } 3<&0", control, input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR 1\nINFO 2\nERROR 2")
+
+	cmd = fmt.Sprintf("echo a | ./%s --control-fd 2 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --control-fd 2")
+}
+
+func TestCanonical(t *testing.T) {
+	cmd := fmt.Sprintf(`printf 'b\nERROR z\nx\n\033[1mERROR a\033[0m\nERROR a\n' | ./%s --canonical --color -f ERROR`, binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[1mERROR a\x1b[0m\nERROR a\nERROR z\nb\nx")
+
+	cmd = fmt.Sprintf("echo a | ./%s --canonical --final-tie none 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "--canonical conflicts with --final-tie none")
+}
+
+func TestFlushOnPriority(t *testing.T) {
+	// Without the trigger everything waits for EOF and sorts together
+	input := `(printf 'WARN b\nINFO x\nERROR c\n'; sleep 0.3; printf 'ERROR a\nWARN a\n')`
+	cmd := fmt.Sprintf("%s | ./%s -f FATAL,ERROR,WARN --deterministic --flush-on-priority 1", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR c\nWARN b\nINFO x\nERROR a\nWARN a")
+
+	cmd = fmt.Sprintf("%s | ./%s -f FATAL,ERROR,WARN --deterministic", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR a\nERROR c\nWARN a\nWARN b\nINFO x")
+}
+
+func TestPidFileAndReload(t *testing.T) {
+	input := `(printf 'INFO 1\nERROR 1\n'; sleep 0.5; printf 'INFO 2\nERROR 2\n')`
+	cmd := fmt.Sprintf("printf 'ERROR\\n' > reload.txt; %s | ./%s --deterministic --pid-file reload.pid reload.txt & sleep 0.2; printf 'INFO\\n' > reload.txt; kill -HUP $(cat reload.pid); wait; test -e reload.pid && echo 'pid file left'; rm -f reload.txt", input, binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR 1\nINFO 2\nERROR 2\nINFO 1")
+
+	// A signal ends the run like EOF and still removes the PID file
+	cmd = fmt.Sprintf("sleep 1 | ./%s --pid-file term.pid -f x & sleep 0.2; kill $(cat term.pid); wait; test -e term.pid && echo 'pid file left'; true", binName)
+	CheckString(t, runPipeline(t, cmd), "")
+}
+
+func TestSourceOrder(t *testing.T) {
+	cmd := fmt.Sprintf(`seq 1 3 | ./%s --stdin -e "sh -c 'sleep 0.1; echo a; echo b'" --source-order stdin-first --no-sort`, binName)
+	CheckString(t, runPipeline(t, cmd), "1\n2\n3\na\nb")
+
+	cmd = fmt.Sprintf(`seq 1 3 | ./%s --stdin -e "sh -c 'sleep 0.1; echo a; echo b'" --source-order exec-first --no-sort`, binName)
+	CheckString(t, runPipeline(t, cmd), "a\nb\n1\n2\n3")
+
+	cmd = fmt.Sprintf("echo a | ./%s --source-order random 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "Invalid --source-order 'random'")
+}
+
+func TestHighlightAll(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'db ERROR in db\\nxERRORx\\nnone\\n' | ./%s --highlight-all -f ERROR,db,re:R+", binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[1;33mdb\x1b[0m \x1b[1;31mERROR\x1b[0m in \x1b[1;33mdb\x1b[0m\nx\x1b[1;31mERROR\x1b[0mx\nnone")
+
+	// Original colors come back after each highlight
+	cmd = fmt.Sprintf(`printf '\033[32mdb ERROR\033[0m\n' | ./%s --color --highlight-all -f ERROR,db`, binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[32m\x1b[1;33mdb\x1b[0m\x1b[32m \x1b[1;31mERROR\x1b[0m\x1b[32m\x1b[0m")
+}
+
+func TestTruncate(t *testing.T) {
+	cmd := fmt.Sprintf("printf 'ERROR in the database layer\\nshort\\nünïcödé line here\\n' | ./%s --truncate 10 -f ERROR", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR in …\nshort\nünïcödé l…")
+
+	// Escape sequences don't count and aren't cut
+	cmd = fmt.Sprintf("printf 'db ERROR in the database\\n' | ./%s --truncate 7 --highlight -f ERROR", binName)
+	CheckString(t, runPipeline(t, cmd), "db \x1b[1;31mERR…\x1b[0m")
+
+	// --squeeze compares the lines whole
+	cmd = fmt.Sprintf("printf 'ERROR in the db\\nERROR in the cache\\n' | ./%s --truncate 10 --squeeze -f ERROR", binName)
+	CheckString(t, runPipeline(t, cmd), "ERROR in …\nERROR in …")
+}
+
+func TestWatch(t *testing.T) {
+	// A rewrite by rename, with the file briefly missing, redraws the view
+	cmd := fmt.Sprintf("printf 'b\\nERROR 1\\n' > watch.txt; timeout -s INT 1 ./%s --watch watch.txt --watch-interval 50ms -f ERROR & sleep 0.3; rm watch.txt; sleep 0.2; printf 'WARN\\nERROR 2\\n' > watch.tmp; mv watch.tmp watch.txt; wait; rm -f watch.txt", binName)
+	CheckString(t, runPipeline(t, cmd), "\x1b[H\x1b[2JERROR 1\nb\n\x1b[H\x1b[2JERROR 2\nWARN")
+
+	cmd = fmt.Sprintf("./%s --watch x.txt -e 'echo a' 2>&1 || true", binName)
+	CheckPrefix(t, runPipeline(t, cmd), "--watch conflicts with -e")
+}
+
+func TestSample(t *testing.T) {
+	cmd := fmt.Sprintf("seq 1 10 | ./%s --sample 3 --no-sort", binName)
+	CheckString(t, runPipeline(t, cmd), "3\n6\n9")
+
+	// Matching lines are never sampled out with --sample-keep-matches
+	cmd = fmt.Sprintf("seq 1 10 | ./%s --sample 3 --sample-keep-matches -f 1", binName)
+	CheckString(t, runPipeline(t, cmd), "1\n10\n3\n6\n9")
+
+	cmd = fmt.Sprintf("seq 1 1000 | ./%s --sample 10 --sample-random", binName)
+	if n := len(strings.Fields(runPipeline(t, cmd))); n == 0 || n >= 1000 {
+		t.Errorf("--sample 10 --sample-random kept %d of 1000 lines", n)
+	}
+
+	// --stats only counts the lines that weren't sampled out
+	cmd = fmt.Sprintf("seq 1 10 | ./%s --sample 5 --sample-keep-matches --stats -f 1 2>&1 >/dev/null", binName)
+	expected := `
+FILTER       PRIORITY  MATCHES  PERCENT
+1            0         2        66.7%
+(unmatched)  -         1        33.3%
+`
+	CheckString(t, runPipeline(t, cmd), expected)
+}
+
+func TestFilterSource(t *testing.T) {
+	cmd := fmt.Sprintf("printf -- '--match-report\\n# errors\\nERROR\\n\\ndb\\n' > source.filters; printf 'db ERROR x\\nfoo\\n' | ./%s source.filters; rm -f source.filters", binName)
+	CheckString(t, runPipeline(t, cmd), "db ERROR x {ERROR [source.filters:3],db [source.filters:5]}\nfoo")
+
+	// Filters from the command line have no source
+	cmd = fmt.Sprintf("mkdir -p source.d; printf 'ERROR\\n' > source.d/a; printf 'db ERROR x\\n' | ./%s --dry-match --filter-dir source.d -f db; rm -rf source.d", binName)
+	CheckString(t, runPipeline(t, cmd), "db ERROR x [priority=0 filter=ERROR [source.d/a:1]]")
+}